@@ -5,6 +5,7 @@ go 1.24.1
 require (
 	github.com/alecthomas/kingpin v2.2.6+incompatible
 	github.com/prometheus/procfs v0.16.0
+	github.com/vimalk78/ebpf-proc-hybrid v0.0.0
 )
 
 require (
@@ -12,3 +13,5 @@ require (
 	github.com/alecthomas/units v0.0.0-20240927000941-0f3dac36c52b // indirect
 	golang.org/x/sys v0.30.0 // indirect
 )
+
+replace github.com/vimalk78/ebpf-proc-hybrid => ../hybrid
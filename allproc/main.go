@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -13,16 +18,33 @@ import (
 
 	"github.com/alecthomas/kingpin"
 	"github.com/prometheus/procfs"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
 )
 
 var (
 	app          = kingpin.New("allproc", "reads all processes from /proc to get procsess cpu usage")
 	loopInterval = app.Flag("loop-interval", "loop interval").Default("1000ms").Duration()
 	enablePprof  = app.Flag("enable-pprof", "enable profiling with pprof").Default("false").Bool()
+	recordFile   = app.Flag("record", "record the raw inputs of every tick to a file").String()
+	replayFile   = app.Flag("replay", "replay a recording instead of reading /proc").ExistingFile()
+
+	runCmd = app.Command("run", "print the cpu usage of all processes every loop interval").Default()
+
+	benchCmd   = app.Command("bench", "run a number of ticks and print statistics of the collection cost")
+	benchTicks = benchCmd.Flag("ticks", "number of ticks to measure").Default("60").Int()
+	benchJSON  = benchCmd.Flag("json", "also write the result as JSON to this file").String()
 )
 
 func main() {
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if *replayFile != "" {
+		if err := replay(*replayFile); err != nil {
+			log.Error("replay failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 	// Subscribe to signals for terminating the program
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -36,8 +58,31 @@ func main() {
 		setupPprof()
 	}
 
+	if cmd == benchCmd.FullCommand() {
+		if err := runBench(ctx, *benchTicks, *benchJSON); err != nil {
+			log.Error("bench failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var rec *recorder
+	if *recordFile != "" {
+		var err error
+		rec, err = newRecorder(*recordFile, recordHeader{
+			Tool:     "allproc",
+			NumCPU:   runtime.NumCPU(),
+			Interval: *loopInterval,
+		})
+		if err != nil {
+			log.Error("cannot record", "error", err)
+			os.Exit(1)
+		}
+		defer rec.Close()
+	}
+
 	doneCh := make(chan struct{})
-	go run(ctx, doneCh)
+	go run(ctx, rec, doneCh)
 
 	<-ctx.Done()
 	log.Info("received Ctrl-C.")
@@ -45,10 +90,11 @@ func main() {
 	log.Info("Shutting down...")
 }
 
-func run(ctx context.Context, doneCh chan struct{}) {
+func run(ctx context.Context, rec *recorder, doneCh chan struct{}) {
 	log.Info("Starting loop", "interval", loopInterval)
 	ticker := time.Tick(*loopInterval)
 	oldTs := time.Now()
+	tracker := newTracker()
 
 	for {
 		select {
@@ -57,20 +103,13 @@ func run(ctx context.Context, doneCh chan struct{}) {
 			if timeDiffSec < 0.1 {
 				continue
 			}
-			// get all procs
-			allProcs, err := procfs.AllProcs()
-			if err != nil {
-				log.Error("cannot read AllProcs")
-			}
-			// read /proc/<pid>/stat for each
-			for _, proc := range allProcs {
-				// deliberately ignoring the returned stat object
-				_, err := proc.Stat()
-				if err != nil {
-					log.Error("cannot read stat for pid", "pid", proc.PID)
+			num, cpu := collect(procfs.DefaultMountPoint, tracker, newTs, rec)
+			log.Info("AllProcs", "num", num, "cpu", cpu, "cost", time.Since(newTs).String())
+			if rec != nil {
+				if err := rec.commit(newTs); err != nil {
+					log.Error("cannot record tick", "error", err)
 				}
 			}
-			log.Info("AllProcs", "num", len(allProcs), "cost", time.Since(newTs).String())
 
 		case <-ctx.Done():
 			log.Info("loop finished...")
@@ -80,6 +119,120 @@ func run(ctx context.Context, doneCh chan struct{}) {
 	}
 }
 
+// replay runs the recorded ticks through procfs, without reading /proc
+func replay(path string) error {
+	r, hdr, err := newReplayer(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	log.Info("Replaying", "file", path, "tool", hdr.Tool, "interval", hdr.Interval)
+	tracker := newTracker()
+	ticks := 0
+	for {
+		root, ts, err := r.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		startedAt := time.Now()
+		num, cpu := collect(root, tracker, ts, nil)
+		log.Info("AllProcs", "tick", ts.Format(time.RFC3339Nano), "num", num, "cpu", cpu, "cost", time.Since(startedAt).String())
+		ticks++
+	}
+	log.Info("Replay finished", "ticks", ticks)
+	return nil
+}
+
+/*
+collect reads the stat of every process of the /proc tree at root, and
+returns the number of processes read and the cpu seconds they used since the
+previous tick. Every file is read once, and the bytes parsed are the ones
+recorded, so a replay computes the same numbers.
+*/
+func collect(root string, tracker *tracker, ts time.Time, rec *recorder) (int, float64) {
+	fs, err := procfs.NewFS(root)
+	if err != nil {
+		log.Error("cannot open proc tree", "root", root, "error", err)
+		return 0, 0
+	}
+	// get all procs
+	allProcs, err := fs.AllProcs()
+	if err != nil {
+		log.Error("cannot read AllProcs")
+	}
+	// read /proc/<pid>/stat for each
+	stats := make([]proc.PidStat, 0, len(allProcs))
+	for _, p := range allProcs {
+		if rec != nil {
+			rec.addPid(p.PID)
+		}
+		data, err := os.ReadFile(filepath.Join(root, strconv.Itoa(p.PID), "stat"))
+		if err != nil {
+			log.Error("cannot read stat for pid", "pid", p.PID)
+			continue
+		}
+		if rec != nil {
+			rec.addPidStat(p.PID, data)
+		}
+		stat, err := proc.ParsePidStat(uint32(p.PID), string(data))
+		if err != nil {
+			log.Error("cannot parse stat for pid", "pid", p.PID, "error", err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	// /proc/stat gives the boot time, to tell processes started in this interval
+	var uptime proc.CpuTicks
+	data, err := os.ReadFile(filepath.Join(root, "stat"))
+	if err != nil {
+		log.Error("cannot read /proc/stat", "error", err)
+	} else {
+		if rec != nil {
+			rec.addCpuStat(data)
+		}
+		btime, err := proc.ParseBootTime(string(data))
+		if err != nil {
+			log.Error("cannot parse /proc/stat", "error", err)
+		} else if secs := ts.Unix() - int64(btime); secs > 0 {
+			uptime = proc.CpuTicks(secs) * proc.UserHZ
+		}
+	}
+	ticks := tracker.update(uptime, stats)
+	return len(stats), float64(ticks) / proc.UserHZ
+}
+
+// tracker computes the cpu time deltas between ticks with the tracker of
+// ebpf-proc-hybrid. Every process is read each tick, so the processes not
+// read have exited, and are forgotten.
+type tracker struct {
+	*usage.Tracker
+	// pids read in the previous tick
+	pids map[uint32]bool
+}
+
+func newTracker() *tracker {
+	return &tracker{Tracker: usage.NewTracker()}
+}
+
+// update returns the cpu ticks used by stats since the previous update
+func (t *tracker) update(uptime proc.CpuTicks, stats []proc.PidStat) proc.CpuTicks {
+	deltas := t.Update(uptime, stats)
+	pids := make(map[uint32]bool, len(stats))
+	for _, stat := range stats {
+		pids[stat.Pid] = true
+	}
+	for pid := range t.pids {
+		if !pids[pid] {
+			t.Forget(pid)
+		}
+	}
+	t.pids = pids
+	return usage.Sum(deltas)
+}
+
 func setupPprof() {
 	go func() {
 		http.ListenAndServe(":6060", http.DefaultServeMux)
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// recordVersion of the recording format, shared with ebpf-proc-hybrid
+const recordVersion = 1
+
+// recordHeader is written once at the start of a recording
+type recordHeader struct {
+	Version  int
+	Tool     string
+	NumCPU   int
+	Interval time.Duration
+}
+
+// recordTick holds the raw inputs of one collection interval.
+// Field names match the ebpf-proc-hybrid recording, so either tool can
+// replay the other's recording.
+type recordTick struct {
+	Time time.Time
+	// Pids listed in /proc
+	Pids []uint32
+	// CpuStat is the content of /proc/stat
+	CpuStat []byte
+	// PidStats is the content of /proc/<pid>/stat for every pid read
+	// successfully. Failed reads are not recorded.
+	PidStats map[uint32][]byte
+}
+
+// recorder writes a gzip compressed stream of gob encoded ticks
+type recorder struct {
+	f    *os.File
+	zw   *gzip.Writer
+	enc  *gob.Encoder
+	tick recordTick
+}
+
+func newRecorder(path string, hdr recordHeader) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create recording: %w", err)
+	}
+	zw := gzip.NewWriter(f)
+	r := &recorder{f: f, zw: zw, enc: gob.NewEncoder(zw)}
+	hdr.Version = recordVersion
+	if err := r.enc.Encode(&hdr); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("cannot write recording header: %w", err)
+	}
+	r.reset()
+	return r, nil
+}
+
+func (r *recorder) reset() {
+	r.tick = recordTick{PidStats: map[uint32][]byte{}}
+}
+
+// addCpuStat records data, the content of /proc/stat
+func (r *recorder) addCpuStat(data []byte) {
+	r.tick.CpuStat = data
+}
+
+// addPid records a pid listed in /proc
+func (r *recorder) addPid(pid int) {
+	r.tick.Pids = append(r.tick.Pids, uint32(pid))
+}
+
+// addPidStat records data, the content of /proc/<pid>/stat
+func (r *recorder) addPidStat(pid int, data []byte) {
+	r.tick.PidStats[uint32(pid)] = data
+}
+
+// commit writes the inputs added since the previous commit as the tick at ts
+func (r *recorder) commit(ts time.Time) error {
+	r.tick.Time = ts
+	err := r.enc.Encode(&r.tick)
+	r.reset()
+	if err != nil {
+		return fmt.Errorf("cannot write tick: %w", err)
+	}
+	return nil
+}
+
+func (r *recorder) Close() error {
+	return errors.Join(r.zw.Close(), r.f.Close())
+}
+
+// replayer reads a recording and lays out each tick as a /proc tree in a
+// temporary directory, so that it is parsed by procfs just like /proc
+type replayer struct {
+	f   *os.File
+	zr  *gzip.Reader
+	dec *gob.Decoder
+	dir string
+}
+
+func newReplayer(path string) (*replayer, recordHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, recordHeader{}, fmt.Errorf("cannot open recording: %w", err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, recordHeader{}, fmt.Errorf("invalid recording %s: %w", path, err)
+	}
+	dir, err := os.MkdirTemp("", "allproc-replay-")
+	if err != nil {
+		zr.Close()
+		f.Close()
+		return nil, recordHeader{}, err
+	}
+	r := &replayer{f: f, zr: zr, dec: gob.NewDecoder(zr), dir: dir}
+	var hdr recordHeader
+	if err := r.dec.Decode(&hdr); err != nil {
+		r.Close()
+		return nil, recordHeader{}, fmt.Errorf("cannot read recording header: %w", err)
+	}
+	if hdr.Version != recordVersion {
+		r.Close()
+		return nil, recordHeader{}, fmt.Errorf("unsupported recording version %d", hdr.Version)
+	}
+	return r, hdr, nil
+}
+
+// next writes the next tick under the returned directory, or returns io.EOF
+func (r *replayer) next() (string, time.Time, error) {
+	var tick recordTick
+	if err := r.dec.Decode(&tick); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", time.Time{}, io.EOF
+		}
+		return "", time.Time{}, fmt.Errorf("cannot read tick: %w", err)
+	}
+	root := filepath.Join(r.dir, "proc")
+	if err := os.RemoveAll(root); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := os.Mkdir(root, 0o755); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := os.WriteFile(filepath.Join(root, "stat"), tick.CpuStat, 0o644); err != nil {
+		return "", time.Time{}, err
+	}
+	pids := tick.Pids
+	if len(pids) == 0 {
+		// recorded by ebpf-proc-hybrid, only the pids read are known
+		pids = slices.Collect(maps.Keys(tick.PidStats))
+	}
+	for _, pid := range pids {
+		pidDir := filepath.Join(root, strconv.Itoa(int(pid)))
+		if err := os.Mkdir(pidDir, 0o755); err != nil {
+			return "", time.Time{}, err
+		}
+		// a pid without stat exited between listing and reading
+		data, ok := tick.PidStats[pid]
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(pidDir, "stat"), data, 0o644); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return root, tick.Time, nil
+}
+
+func (r *replayer) Close() error {
+	return errors.Join(r.zr.Close(), r.f.Close(), os.RemoveAll(r.dir))
+}
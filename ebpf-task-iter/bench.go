@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// benchSample is the cost of one collection tick
+type benchSample struct {
+	Wall              time.Duration
+	CPU               time.Duration // user + system time of the whole process
+	Allocs            uint64        // heap objects allocated
+	AllocBytes        uint64        // heap bytes allocated
+	ReadWriteSyscalls uint64        // read and write syscalls from /proc/self/io, bpf() is not counted
+}
+
+type snapshot struct {
+	wall              time.Time
+	cpu               time.Duration
+	allocs            uint64
+	allocBytes        uint64
+	readWriteSyscalls uint64
+}
+
+// meter measures the cost of the code run between startMeter and stop
+type meter struct {
+	start snapshot
+}
+
+func startMeter() *meter {
+	m := &meter{}
+	// the cheapest and least disturbing reading is taken last
+	m.start.readWriteSyscalls = readRWSyscalls()
+	m.start.allocs, m.start.allocBytes = readAllocs()
+	m.start.cpu = readCPU()
+	m.start.wall = time.Now()
+	return m
+}
+
+func (m *meter) stop() benchSample {
+	wall := time.Now()
+	cpu := readCPU()
+	allocs, allocBytes := readAllocs()
+	readWriteSyscalls := readRWSyscalls() - syscallOverhead()
+	return benchSample{
+		Wall:              wall.Sub(m.start.wall),
+		CPU:               cpu - m.start.cpu,
+		Allocs:            allocs - m.start.allocs,
+		AllocBytes:        allocBytes - m.start.allocBytes,
+		ReadWriteSyscalls: readWriteSyscalls - m.start.readWriteSyscalls,
+	}
+}
+
+func readCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func readAllocs() (uint64, uint64) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs, ms.TotalAlloc
+}
+
+// syscallOverhead is the number of read and write syscalls counted for reading /proc/self/io
+var syscallOverhead = sync.OnceValue(func() uint64 {
+	before := readRWSyscalls()
+	return readRWSyscalls() - before
+})
+
+// readRWSyscalls returns syscr + syscw of /proc/self/io
+func readRWSyscalls() uint64 {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0
+	}
+	var total uint64
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		key, val, ok := strings.Cut(string(line), ": ")
+		if !ok || (key != "syscr" && key != "syscw") {
+			continue
+		}
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// benchSummary holds the statistics of one metric over all ticks
+type benchSummary struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Median float64 `json:"median"`
+	P99    float64 `json:"p99"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+}
+
+// summarize returns the statistics of values
+func summarize(values []float64) benchSummary {
+	if len(values) == 0 {
+		return benchSummary{}
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	var sq float64
+	for _, v := range sorted {
+		sq += (v - mean) * (v - mean)
+	}
+	return benchSummary{
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Median: percentile(sorted, 50),
+		P99:    percentile(sorted, 99),
+		Mean:   mean,
+		StdDev: math.Sqrt(sq / float64(len(sorted))),
+	}
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// benchResult is the outcome of a bench run, comparable across hosts.
+// The JSON encoding matches the bench of allproc and ebpf-proc-hybrid.
+type benchResult struct {
+	Tool     string                  `json:"tool"`
+	Strategy string                  `json:"strategy"`
+	Host     string                  `json:"host"`
+	Kernel   string                  `json:"kernel"`
+	NumCPU   int                     `json:"num_cpu"`
+	Interval string                  `json:"interval"`
+	Ticks    int                     `json:"ticks"`
+	Procs    benchSummary            `json:"procs"`
+	Metrics  map[string]benchSummary `json:"metrics"`
+}
+
+// bench metric names, with their unit
+const (
+	metricWallUs            = "wall_us"
+	metricCPUUs             = "cpu_us"
+	metricAllocs            = "allocs"
+	metricAllocBytes        = "alloc_bytes"
+	metricReadWriteSyscalls = "read_write_syscalls"
+)
+
+// newBenchResult summarizes samples. procs is the number of processes
+// collected in each tick.
+func newBenchResult(tool, strategy string, interval time.Duration, samples []benchSample, procs []int) benchResult {
+	values := map[string][]float64{}
+	for _, s := range samples {
+		values[metricWallUs] = append(values[metricWallUs], float64(s.Wall.Nanoseconds())/1e3)
+		values[metricCPUUs] = append(values[metricCPUUs], float64(s.CPU.Nanoseconds())/1e3)
+		values[metricAllocs] = append(values[metricAllocs], float64(s.Allocs))
+		values[metricAllocBytes] = append(values[metricAllocBytes], float64(s.AllocBytes))
+		values[metricReadWriteSyscalls] = append(values[metricReadWriteSyscalls], float64(s.ReadWriteSyscalls))
+	}
+	procValues := make([]float64, len(procs))
+	for i, n := range procs {
+		procValues[i] = float64(n)
+	}
+	r := benchResult{
+		Tool:     tool,
+		Strategy: strategy,
+		Kernel:   kernelRelease(),
+		NumCPU:   runtime.NumCPU(),
+		Interval: interval.String(),
+		Ticks:    len(samples),
+		Procs:    summarize(procValues),
+		Metrics:  map[string]benchSummary{},
+	}
+	r.Host, _ = os.Hostname()
+	for name, v := range values {
+		r.Metrics[name] = summarize(v)
+	}
+	return r
+}
+
+func kernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// print writes a human readable table of r
+func (r benchResult) print(w io.Writer) {
+	fmt.Fprintf(w, "%s (%s) on %s, kernel %s, %d cpus, %d ticks every %s\n",
+		r.Tool, r.Strategy, r.Host, r.Kernel, r.NumCPU, r.Ticks, r.Interval)
+	fmt.Fprintf(w, "%-20s %12s %12s %12s %12s %12s %12s\n", "metric", "min", "max", "median", "p99", "mean", "stddev")
+	row := func(name string, s benchSummary) {
+		fmt.Fprintf(w, "%-20s %12.1f %12.1f %12.1f %12.1f %12.1f %12.1f\n", name, s.Min, s.Max, s.Median, s.P99, s.Mean, s.StdDev)
+	}
+	row("procs", r.Procs)
+	for _, name := range []string{metricWallUs, metricCPUUs, metricAllocs, metricAllocBytes, metricReadWriteSyscalls} {
+		row(name, r.Metrics[name])
+	}
+}
+
+// writeJSON writes r to path
+func (r benchResult) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// runBench measures the cost of every collection tick
+func runBench(objs *cpuTimeObjects, its []*link.Iter, cfg Config) error {
+	// Store previous CPU times to calculate deltas
+	history := NewHistory(cfg.cacheSize)
+
+	// Set up signal handling for clean shutdown
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	fmt.Printf("Measuring %d collections at %s intervals...\n", cfg.ticks, cfg.interval)
+	samples := make([]benchSample, 0, cfg.ticks)
+	procs := make([]int, 0, cfg.ticks)
+loop:
+	for len(samples) < cfg.ticks {
+		select {
+		case <-ticker.C:
+			m := startMeter()
+			usageData, _, err := collectCPUData(objs, its, history, cfg)
+			samples = append(samples, m.stop())
+			if err != nil {
+				log.Printf("Error collecting CPU data: %v", err)
+			}
+			procs = append(procs, len(usageData))
+		case <-stopper:
+			break loop
+		}
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no ticks measured")
+	}
+
+	result := newBenchResult("ebpf-task-iter", "task-iter-"+cfg.mode, cfg.interval, samples, procs)
+	result.print(os.Stdout)
+	if cfg.benchJSON != "" {
+		if err := result.writeJSON(cfg.benchJSON); err != nil {
+			return fmt.Errorf("cannot write %s: %v", cfg.benchJSON, err)
+		}
+	}
+	return nil
+}
@@ -1,39 +1,74 @@
 //go:build ignore
 
-#include <linux/bpf.h>
+#include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
-#include <linux/types.h> // For pid_t
-
-// Define pid_t if not provided
-#ifndef pid_t
-typedef int pid_t;
-#endif
+#include <bpf/bpf_core_read.h>
 
 // Define TASK_COMM_LEN if not provided
 #ifndef TASK_COMM_LEN
 #define TASK_COMM_LEN 16
 #endif
 
-// Define struct bpf_iter__task
-struct bpf_iter__task {
-    struct task_struct *task;
+// Fields renamed across kernel versions. Both flavors are declared here so
+// the program builds against the vmlinux.h of any kernel, and
+// bpf_core_field_exists picks the one of the running kernel at load time.
+
+// task_struct.state was renamed __state in 5.14
+struct task_struct___new {
+    unsigned int __state;
 } __attribute__((preserve_access_index));
 
-// Define necessary parts of struct task_struct
-struct task_struct {
-    pid_t tgid;                   // Thread group ID (process ID)
-    unsigned long long utime;     // User CPU time
-    unsigned long long stime;     // System CPU time
-    char comm[TASK_COMM_LEN];     // Command name
+struct task_struct___old {
+    long state;
 } __attribute__((preserve_access_index));
 
+// task_state returns __state | exit_state of task
+static __always_inline __u32 task_state(struct task_struct *task)
+{
+    struct task_struct___new *t = (void *)task;
+    __u32 state;
+
+    if (bpf_core_field_exists(t->__state)) {
+        state = BPF_CORE_READ(t, __state);
+    } else {
+        state = BPF_CORE_READ((struct task_struct___old *)task, state);
+    }
+    return state | BPF_CORE_READ(task, exit_state);
+}
+
 // Data structure to store process information
 struct process_info {
-    unsigned long long cpu_time;   // Total CPU time
+    unsigned long long cpu_time;   // Total CPU time in ns
+    unsigned long long start_time; // Start time of the process in ns, tells reused pids apart
+    __u32 ppid;                    // Thread group ID of the parent
+    __u32 state;                   // State of the main thread, __state | exit_state
+    __u32 nr_threads;              // Number of threads
+    __u32 exe_dev;                 // Device of the executable, 0 for kernel threads
+    __u64 cgroup_id;               // cgroup v2 id
+    __u64 exe_ino;                 // Inode of the executable, 0 for kernel threads
     char comm[TASK_COMM_LEN];      // Command name
 };
 
+// Record written to the iterator output for every task (thread)
+struct task_record {
+    __u32 tgid;                    // Thread group ID (process ID)
+    __u32 pid;                     // Thread ID
+    unsigned long long cpu_time;   // CPU time of the thread in ns, with the exited threads for the main one
+    unsigned long long start_time; // Start time of the process in ns
+    __u32 ppid;                    // Thread group ID of the parent
+    __u32 state;                   // State of the main thread, __state | exit_state
+    __u32 nr_threads;              // Number of threads
+    __u32 exe_dev;                 // Device of the executable, 0 for kernel threads
+    __u64 cgroup_id;               // cgroup v2 id
+    __u64 exe_ino;                 // Inode of the executable, 0 for kernel threads
+    char comm[TASK_COMM_LEN];      // Command name
+};
+
+// Force emitting struct task_record into the ELF for bpf2go -type
+const struct task_record *unused_task_record __attribute__((unused));
+
 // BPF map to store process information
+// max_entries is overridden from userspace before load
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 1024);
@@ -41,18 +76,49 @@ struct {
     __type(value, struct process_info); // Value: Process information
 } process_map SEC(".maps");
 
-// BPF iterator program
-SEC("iter/task")
-int sum_cpu_time(struct bpf_iter__task *ctx)
+// fill_process_info fills the process wide fields of info from the main
+// thread of the process task belongs to
+static __always_inline void fill_process_info(struct process_info *info, struct task_struct *task)
 {
-    struct task_struct *task = ctx->task;
-    if (task == NULL) {
-        return 0; // Skip if no task
+    struct task_struct *leader = BPF_CORE_READ(task, group_leader);
+
+    info->start_time = BPF_CORE_READ(leader, start_time);
+    info->ppid = BPF_CORE_READ(leader, real_parent, tgid);
+    info->state = task_state(leader);
+    info->nr_threads = BPF_CORE_READ(task, signal, nr_threads);
+    info->cgroup_id = BPF_CORE_READ(leader, cgroups, dfl_cgrp, kn, id);
+
+    struct file *exe_file = BPF_CORE_READ(task, mm, exe_file);
+    if (exe_file) {
+        struct inode *inode = BPF_CORE_READ(exe_file, f_inode);
+        info->exe_ino = BPF_CORE_READ(inode, i_ino);
+        info->exe_dev = BPF_CORE_READ(inode, i_sb, s_dev);
     }
+}
+
+// task_cpu_time returns the cpu time of task in ns. The main thread also
+// carries the cpu time of the exited threads of its process, kept in
+// signal_struct as /proc/<pid>/stat adds it, so the process total does not
+// drop when a thread exits.
+static __always_inline unsigned long long task_cpu_time(struct task_struct *task)
+{
+    unsigned long long cpu_time = BPF_CORE_READ(task, utime) + BPF_CORE_READ(task, stime);
+
+    if (BPF_CORE_READ(task, pid) == BPF_CORE_READ(task, tgid)) {
+        cpu_time += BPF_CORE_READ(task, signal, utime) + BPF_CORE_READ(task, signal, stime);
+    }
+    return cpu_time;
+}
 
-    // Calculate total CPU time
-    pid_t tgid = task->tgid;
-    unsigned long long cpu_time = task->utime + task->stime;
+// Number of processes not added to process_map because it was full,
+// reset by userspace before every run of the iterator
+__u64 failed_inserts = 0;
+
+// count_task adds the cpu time of task to its process in process_map
+static __always_inline void count_task(struct task_struct *task)
+{
+    pid_t tgid = BPF_CORE_READ(task, tgid);
+    unsigned long long cpu_time = task_cpu_time(task);
 
     // Update the map
     struct process_info *info = bpf_map_lookup_elem(&process_map, &tgid);
@@ -64,13 +130,124 @@ int sum_cpu_time(struct bpf_iter__task *ctx)
         struct process_info new_info = {
             .cpu_time = cpu_time
         };
-        
+        fill_process_info(&new_info, task);
+
         // Copy the command name
-        __builtin_memcpy(new_info.comm, task->comm, TASK_COMM_LEN);
+        BPF_CORE_READ_STR_INTO(&new_info.comm, task, comm);
         
-        bpf_map_update_elem(&process_map, &tgid, &new_info, BPF_NOEXIST);
+        if (bpf_map_update_elem(&process_map, &tgid, &new_info, BPF_NOEXIST) != 0) {
+            __sync_fetch_and_add(&failed_inserts, 1);
+        }
+    }
+}
+
+// dump_task writes a task_record of task with cpu_time to seq
+static __always_inline void dump_task(struct seq_file *seq, struct task_struct *task, unsigned long long cpu_time)
+{
+    struct process_info info = {};
+    fill_process_info(&info, task);
+
+    struct task_record rec = {
+        .tgid = BPF_CORE_READ(task, tgid),
+        .pid = BPF_CORE_READ(task, pid),
+        .cpu_time = cpu_time,
+        .start_time = info.start_time,
+        .ppid = info.ppid,
+        .state = info.state,
+        .nr_threads = info.nr_threads,
+        .exe_dev = info.exe_dev,
+        .cgroup_id = info.cgroup_id,
+        .exe_ino = info.exe_ino
+    };
+    BPF_CORE_READ_STR_INTO(&rec.comm, task, comm);
+
+    bpf_seq_write(seq, &rec, sizeof(rec));
+}
+
+// BPF iterator program
+SEC("iter/task")
+int sum_cpu_time(struct bpf_iter__task *ctx)
+{
+    struct task_struct *task = ctx->task;
+    if (task == NULL) {
+        return 0; // Skip if no task
     }
 
+    count_task(task);
+    return 0; // Continue iteration
+}
+
+// BPF iterator program writing one task_record per task to the seq_file,
+// userspace reads and sums them per tgid
+SEC("iter/task")
+int dump_cpu_time(struct bpf_iter__task *ctx)
+{
+    struct task_struct *task = ctx->task;
+    if (task == NULL) {
+        return 0; // Skip if no task
+    }
+
+    dump_task(ctx->meta->seq, task, task_cpu_time(task));
+    return 0; // Continue iteration
+}
+
+// Open-coded iterators, Linux 6.7 or later. css_task iterators are allowed
+// in cgroup iterator programs.
+extern int bpf_iter_css_task_new(struct bpf_iter_css_task *it, struct cgroup_subsys_state *css, unsigned int flags) __ksym;
+extern struct task_struct *bpf_iter_css_task_next(struct bpf_iter_css_task *it) __ksym;
+extern void bpf_iter_css_task_destroy(struct bpf_iter_css_task *it) __ksym;
+extern int bpf_iter_task_new(struct bpf_iter_task *it, struct task_struct *task, unsigned int flags) __ksym;
+extern struct task_struct *bpf_iter_task_next(struct bpf_iter_task *it) __ksym;
+extern void bpf_iter_task_destroy(struct bpf_iter_task *it) __ksym;
+
+// cgroup iterator program, attached to walk the -cgroup cgroup and all its
+// descendants: adds the cpu time of the tasks of every cgroup to
+// process_map, so the tasks of other cgroups are never visited
+SEC("iter/cgroup")
+int sum_cgroup_cpu_time(struct bpf_iter__cgroup *ctx)
+{
+    struct cgroup *cgrp = ctx->cgroup;
+    if (cgrp == NULL) {
+        return 0; // Skip if no cgroup
+    }
+
+    struct bpf_iter_css_task it;
+    struct task_struct *task;
+    bpf_iter_css_task_new(&it, &cgrp->self, 0);
+    while ((task = bpf_iter_css_task_next(&it))) {
+        count_task(task);
+    }
+    bpf_iter_css_task_destroy(&it);
+    return 0; // Continue iteration
+}
+
+// cgroup iterator program writing one task_record per process of every
+// cgroup, with the cpu time of all its threads. The records of a cgroup are
+// written at once, so they are per process rather than per thread to fit in
+// the iterator output buffer.
+SEC("iter/cgroup")
+int dump_cgroup_cpu_time(struct bpf_iter__cgroup *ctx)
+{
+    struct cgroup *cgrp = ctx->cgroup;
+    if (cgrp == NULL) {
+        return 0; // Skip if no cgroup
+    }
+
+    struct bpf_iter_css_task it;
+    struct task_struct *task;
+    bpf_iter_css_task_new(&it, &cgrp->self, CSS_TASK_ITER_PROCS);
+    while ((task = bpf_iter_css_task_next(&it))) {
+        unsigned long long cpu_time = 0;
+        struct bpf_iter_task threads;
+        struct task_struct *thread;
+        bpf_iter_task_new(&threads, task, BPF_TASK_ITER_PROC_THREADS);
+        while ((thread = bpf_iter_task_next(&threads))) {
+            cpu_time += task_cpu_time(thread);
+        }
+        bpf_iter_task_destroy(&threads);
+        dump_task(ctx->meta->seq, task, cpu_time);
+    }
+    bpf_iter_css_task_destroy(&it);
     return 0; // Continue iteration
 }
 
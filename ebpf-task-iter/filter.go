@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// pidList is a flag.Value collecting repeated -pid flags
+type pidList []uint32
+
+func (l *pidList) String() string {
+	pids := make([]string, 0, len(*l))
+	for _, pid := range *l {
+		pids = append(pids, strconv.FormatUint(uint64(pid), 10))
+	}
+	return strings.Join(pids, ",")
+}
+
+func (l *pidList) Set(s string) error {
+	pid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || pid == 0 {
+		return fmt.Errorf("invalid pid %q", s)
+	}
+	// Every pid gets its own iterator, a repeated one would be counted twice
+	if !slices.Contains(*l, uint32(pid)) {
+		*l = append(*l, uint32(pid))
+	}
+	return nil
+}
+
+// cgroupID returns the cgroup v2 id of the cgroup at path, the inode number of
+// its directory. path is either absolute under /sys/fs/cgroup or relative to it,
+// as in /proc/<pid>/cgroup.
+func cgroupID(path string) (uint64, error) {
+	if path != cgroupRoot && !strings.HasPrefix(path, cgroupRoot+"/") {
+		path = filepath.Join(cgroupRoot, path)
+	}
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return 0, fmt.Errorf("cannot stat cgroup %s: %v", path, err)
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return 0, fmt.Errorf("%s is not in a cgroup v2 hierarchy", path)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("cannot stat cgroup %s: %v", path, err)
+	}
+	return st.Ino, nil
+}
+
+// bpfIterLinkInfoTask is union bpf_iter_link_info, as its task member
+type bpfIterLinkInfoTask struct {
+	tid   uint32
+	pid   uint32
+	pidFd uint32
+	_     uint32 // size of the union
+}
+
+// bpfIterLinkInfoCgroup is union bpf_iter_link_info, as its cgroup member
+type bpfIterLinkInfoCgroup struct {
+	order    uint32
+	cgroupFd uint32
+	cgroupID uint64
+}
+
+// bpfCgroupIterDescendantsPre is BPF_CGROUP_ITER_DESCENDANTS_PRE: a cgroup,
+// then its descendants
+const bpfCgroupIterDescendantsPre = 2
+
+// bpfLinkCreateIterAttr is union bpf_attr of BPF_LINK_CREATE for iterators
+type bpfLinkCreateIterAttr struct {
+	progFd     uint32
+	targetFd   uint32
+	attachType uint32
+	flags      uint32
+	// iterInfo is the address of the bpf_iter_link_info, an __aligned_u64
+	// whatever the size of pointers
+	iterInfo    uint64
+	iterInfoLen uint32
+	_           uint32
+}
+
+// attachIter attaches prog as an iterator restricted by info.
+// link.IterOptions has no task or cgroup member, so the link is created with
+// the bpf syscall and wrapped afterwards.
+func attachIter[T bpfIterLinkInfoTask | bpfIterLinkInfoCgroup](prog *ebpf.Program, info *T) (*link.Iter, error) {
+	// info is pinned so its address stays valid through the syscall
+	var pinner runtime.Pinner
+	pinner.Pin(info)
+	defer pinner.Unpin()
+	attr := bpfLinkCreateIterAttr{
+		progFd:      uint32(prog.FD()),
+		attachType:  unix.BPF_TRACE_ITER,
+		iterInfo:    uint64(uintptr(unsafe.Pointer(info))),
+		iterInfoLen: uint32(unsafe.Sizeof(*info)),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_LINK_CREATE, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	l, err := link.NewFromFD(int(fd))
+	if err != nil {
+		return nil, fmt.Errorf("can't wrap iterator link: %v", err)
+	}
+	it, ok := l.(*link.Iter)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("unexpected link type %T for iterator", l)
+	}
+	return it, nil
+}
+
+// attachTaskIter attaches prog as a task iterator over the threads of process
+// pid only. Needs Linux 6.1 or later.
+func attachTaskIter(prog *ebpf.Program, pid uint32) (*link.Iter, error) {
+	it, err := attachIter(prog, &bpfIterLinkInfoTask{pid: pid})
+	if err != nil {
+		return nil, fmt.Errorf("can't link task iterator of pid %d (needs Linux 6.1 or later): %v", pid, err)
+	}
+	return it, nil
+}
+
+// attachCgroupIter attaches prog as a cgroup iterator over the cgroup of id
+// and its descendants. The programs walk the tasks of every cgroup with a
+// css_task iterator, which needs Linux 6.7 or later.
+func attachCgroupIter(prog *ebpf.Program, id uint64) (*link.Iter, error) {
+	it, err := attachIter(prog, &bpfIterLinkInfoCgroup{order: bpfCgroupIterDescendantsPre, cgroupID: id})
+	if err != nil {
+		return nil, fmt.Errorf("can't link cgroup iterator of cgroup %d (needs Linux 6.7 or later): %v", id, err)
+	}
+	return it, nil
+}
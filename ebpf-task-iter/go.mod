@@ -4,10 +4,5 @@ go 1.23.7
 
 require (
 	github.com/cilium/ebpf v0.18.0
-	github.com/tklauser/go-sysconf v0.3.15
-)
-
-require (
-	github.com/tklauser/numcpus v0.10.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/sys v0.31.0
 )
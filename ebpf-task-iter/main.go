@@ -5,45 +5,66 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/bits"
 	"os"
 	"os/signal"
-	"sort"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
-	"github.com/tklauser/go-sysconf"
 )
 
 // Must match the C struct process_info from the BPF program
 //
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" cpuTime ./cpu_time.bpf.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -type task_record cpuTime ./cpu_time.bpf.c
 
 // ProcessData holds information about a process
 type ProcessData struct {
 	PID        uint32
-	CPUTime    uint64
-	LastTime   uint64
+	CPUTime    uint64 // CPU time in ns
+	StartTime  uint64 // Monotonic start time in ns
+	Ppid       uint32
+	State      uint32 // Kernel task state of the main thread
+	NrThreads  uint32
+	CgroupID   uint64
+	ExeDev     uint32 // Device and inode of the executable, 0 for kernel threads
+	ExeIno     uint64
 	Comm       string
 	Executable string
+	Cmdline    string
+	Cgroup     string
 }
 
 // ProcessUsage represents CPU usage for a process
 type ProcessUsage struct {
 	PID        uint32
+	Ppid       uint32
+	State      byte    // State letter as in /proc/<pid>/stat
 	CPUDelta   float64 // Delta in seconds
 	TotalTime  float64 // Total time in seconds
 	Comm       string
 	Executable string
+	Cmdline    string
+	Cgroup     string
 }
 
 // Config holds the application configuration
 type Config struct {
-	interval time.Duration
-	count    int
-	clkTck   int64
+	interval  time.Duration
+	count     int
+	tree      bool
+	wide      bool
+	cacheSize int
+	mode      string
+	maxProcs  uint32
+	bench     bool
+	ticks     int
+	benchJSON string
+	pids      pidList
+	cgroup    string
 }
 
 func main() {
@@ -56,57 +77,150 @@ func main() {
 	}
 
 	// Load and set up BPF program
-	objs, it, err := setupBPF()
+	objs, its, err := setupBPF(cfg)
 	if err != nil {
 		log.Fatalf("Failed to setup BPF: %v", err)
 	}
-	defer cleanup(objs, it)
+	defer cleanup(objs, its)
 
-	// Get system clock tick rate
-	cfg.clkTck, err = sysconf.Sysconf(sysconf.SC_CLK_TCK)
-	if err != nil {
-		log.Fatalf("Error getting CLK_TCK: %v", err)
+	if cfg.bench {
+		if err := runBench(objs, its, cfg); err != nil {
+			log.Fatalf("Bench failed: %v", err)
+		}
+		return
 	}
 
 	// Start monitoring
-	monitor(objs, it, cfg)
+	monitor(objs, its, cfg)
 }
 
-// parseFlags parses command line flags and returns a Config
+// parseFlags parses command line flags and returns a Config.
+// A first argument "bench" measures the collection cost instead of monitoring.
 func parseFlags() Config {
 	interval := flag.Duration("interval", 1*time.Second, "Reporting interval (e.g. 1s, 500ms)")
 	count := flag.Int("count", 0, "Number of top processes to show (0 for all)")
-	flag.Parse()
+	tree := flag.Bool("tree", false, "Show processes as a tree, with the CPU time of each subtree")
+	wide := flag.Bool("wide", false, "Show the cgroup and command line of processes")
+	cacheSize := flag.Int("cache-size", 8192, "Number of processes whose /proc executable, command line and cgroup are cached")
+	mode := flag.String("mode", "map", "How the iterator returns results: map (process_map hash map) or seq (records in the iterator output)")
+	maxProcs := flag.Uint("max-procs", 32768, "Size of process_map, processes beyond it are not counted in map mode")
+	ticks := flag.Int("ticks", 60, "Number of collections to measure in bench mode")
+	benchJSON := flag.String("json", "", "Also write the bench result as JSON to this file")
+	var pids pidList
+	flag.Var(&pids, "pid", "Only iterate the threads of this process, can be repeated (Linux 6.1 or later)")
+	cgroup := flag.String("cgroup", "", "Only count the tasks of this cgroup v2 and its descendants, as a path under /sys/fs/cgroup (Linux 6.7 or later)")
+
+	args := os.Args[1:]
+	bench := len(args) > 0 && args[0] == "bench"
+	if bench {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if *mode != "map" && *mode != "seq" {
+		log.Fatalf("Invalid mode %q, must be map or seq", *mode)
+	}
+	if len(pids) > 0 && *cgroup != "" {
+		log.Fatalf("-pid and -cgroup cannot be combined")
+	}
 
 	return Config{
-		interval: *interval,
-		count:    *count,
+		interval:  *interval,
+		count:     *count,
+		tree:      *tree,
+		wide:      *wide,
+		cacheSize: *cacheSize,
+		mode:      *mode,
+		maxProcs:  uint32(*maxProcs),
+		bench:     bench,
+		ticks:     *ticks,
+		benchJSON: *benchJSON,
+		pids:      pids,
+		cgroup:    *cgroup,
 	}
 }
 
-// setupBPF loads and attaches the BPF program
-func setupBPF() (*cpuTimeObjects, *link.Iter, error) {
+// iterPrograms are the iterator programs of each mode, over all tasks or
+// over the tasks of a cgroup
+var iterPrograms = map[string]struct{ tasks, cgroup string }{
+	"map": {"sum_cpu_time", "sum_cgroup_cpu_time"},
+	"seq": {"dump_cpu_time", "dump_cgroup_cpu_time"},
+}
+
+// setupBPF loads the BPF program of cfg.mode and attaches it as an iterator
+// over all tasks, one per process with -pid, or over the cgroups of -cgroup
+func setupBPF(cfg Config) (*cpuTimeObjects, []*link.Iter, error) {
 	// Load the pre-compiled BPF program
-	objs := cpuTimeObjects{}
-	if err := loadCpuTimeObjects(&objs, nil); err != nil {
-		return nil, nil, fmt.Errorf("failed to load BPF objects: %v", err)
+	spec, err := loadCpuTime()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load BPF spec: %v", err)
 	}
 
-	// Attach the iterator
-	it, err := link.AttachIter(link.IterOptions{
-		Program: objs.SumCpuTime,
-	})
+	// Size process_map before it is created
+	spec.Maps["process_map"].MaxEntries = cfg.maxProcs
+
+	var cgroup uint64
+	name := iterPrograms[cfg.mode].tasks
+	if cfg.cgroup != "" {
+		cgroup, err = cgroupID(cfg.cgroup)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = iterPrograms[cfg.mode].cgroup
+	}
+
+	// Only the program used is loaded, the cgroup ones need Linux 6.7
+	spec.Programs = map[string]*ebpf.ProgramSpec{name: spec.Programs[name]}
+	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load BPF objects: %v", err)
+	}
+	defer coll.Close()
+	objs := cpuTimeObjects{}
+	if err := coll.Assign(&objs.cpuTimeMaps); err != nil {
+		return nil, nil, fmt.Errorf("failed to assign BPF maps: %v", err)
+	}
+	if err := coll.Assign(&objs.cpuTimeVariables); err != nil {
 		objs.Close()
-		return nil, nil, fmt.Errorf("failed to attach BPF iterator: %v", err)
+		return nil, nil, fmt.Errorf("failed to assign BPF variables: %v", err)
+	}
+	// closed with coll, the links hold the program
+	prog := coll.Programs[name]
+
+	// Attach the iterator
+	switch {
+	case cfg.cgroup != "":
+		it, err := attachCgroupIter(prog, cgroup)
+		if err != nil {
+			objs.Close()
+			return nil, nil, fmt.Errorf("failed to attach BPF iterator: %v", err)
+		}
+		return &objs, []*link.Iter{it}, nil
+	case len(cfg.pids) == 0:
+		it, err := link.AttachIter(link.IterOptions{
+			Program: prog,
+		})
+		if err != nil {
+			objs.Close()
+			return nil, nil, fmt.Errorf("failed to attach BPF iterator: %v", err)
+		}
+		return &objs, []*link.Iter{it}, nil
 	}
 
-	return &objs, it, nil
+	var its []*link.Iter
+	for _, pid := range cfg.pids {
+		it, err := attachTaskIter(prog, pid)
+		if err != nil {
+			cleanup(&objs, its)
+			return nil, nil, fmt.Errorf("failed to attach BPF iterator: %v", err)
+		}
+		its = append(its, it)
+	}
+	return &objs, its, nil
 }
 
 // cleanup handles proper resource cleanup
-func cleanup(objs *cpuTimeObjects, it *link.Iter) {
-	if it != nil {
+func cleanup(objs *cpuTimeObjects, its []*link.Iter) {
+	for _, it := range its {
 		it.Close()
 	}
 	if objs != nil {
@@ -115,9 +229,9 @@ func cleanup(objs *cpuTimeObjects, it *link.Iter) {
 }
 
 // monitor starts the main monitoring loop
-func monitor(objs *cpuTimeObjects, it *link.Iter, cfg Config) {
+func monitor(objs *cpuTimeObjects, its []*link.Iter, cfg Config) {
 	// Store previous CPU times to calculate deltas
-	processData := make(map[uint32]ProcessData)
+	history := NewHistory(cfg.cacheSize)
 
 	// Set up signal handling for clean shutdown
 	stopper := make(chan os.Signal, 1)
@@ -130,7 +244,7 @@ func monitor(objs *cpuTimeObjects, it *link.Iter, cfg Config) {
 	fmt.Printf("Monitoring CPU usage at %s intervals... Press Ctrl+C to exit\n", cfg.interval)
 
 	// Initial collection to establish baseline
-	if err := collectAndPrintCPUData(objs, it, processData, cfg); err != nil {
+	if err := collectAndPrintCPUData(objs, its, history, cfg); err != nil {
 		log.Printf("Initial collection error: %v", err)
 	}
 
@@ -138,7 +252,7 @@ func monitor(objs *cpuTimeObjects, it *link.Iter, cfg Config) {
 	for {
 		select {
 		case <-ticker.C:
-			if err := collectAndPrintCPUData(objs, it, processData, cfg); err != nil {
+			if err := collectAndPrintCPUData(objs, its, history, cfg); err != nil {
 				log.Printf("Error collecting CPU data: %v", err)
 			}
 		case <-stopper:
@@ -149,44 +263,84 @@ func monitor(objs *cpuTimeObjects, it *link.Iter, cfg Config) {
 }
 
 // collectAndPrintCPUData collects and displays CPU usage data
-func collectAndPrintCPUData(objs *cpuTimeObjects, it *link.Iter, processData map[uint32]ProcessData, cfg Config) error {
+func collectAndPrintCPUData(objs *cpuTimeObjects, its []*link.Iter, history *History, cfg Config) error {
 	startedAt := time.Now()
-	currentData, keys, err := collectCurrentData(it, objs)
+	usageData, dropped, err := collectCPUData(objs, its, history, cfg)
 	if err != nil {
 		return err
 	}
 
-	// Delete all keys in a batch
-	if _, err := objs.ProcessMap.BatchDelete(keys, nil); err != nil {
-		return fmt.Errorf("failed to batch delete keys: %v", err)
-	}
-
-	// Calculate usage data with deltas
-	usageData := calculateUsageData(currentData, processData, cfg.clkTck)
-
-	// Update stored data for next iteration
-	updateStoredData(processData, currentData)
-
 	// Sort and print results
-	printResults(usageData, cfg.count, startedAt)
+	if cfg.tree {
+		printTree(usageData, cfg.count, cfg.wide, dropped, startedAt)
+		return nil
+	}
+	printResults(usageData, cfg.count, cfg.wide, dropped, startedAt)
 
 	return nil
 }
 
-// collectCurrentData runs the iterator and collects current process data
-func collectCurrentData(it *link.Iter, objs *cpuTimeObjects) (map[uint32]ProcessData, []uint32, error) {
-	// Open iterator to run the iterator
-	iter, err := it.Open()
+// collectCPUData collects CPU usage data and updates history for the next collection.
+// It also returns the number of processes dropped because process_map was full.
+func collectCPUData(objs *cpuTimeObjects, its []*link.Iter, history *History, cfg Config) ([]ProcessUsage, uint64, error) {
+	// Processes started after this are not seen by the iterator
+	collectedAt, err := monotonicNow()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open iterator: %v", err)
+		return nil, 0, err
 	}
-	defer iter.Close()
 
-	// Read to run the iterator (no output expected)
-	buf := make([]byte, 1)
-	_, err = iter.Read(buf)
-	if err != nil && !errors.Is(err, os.ErrClosed) && err.Error() != "EOF" {
-		return nil, nil, fmt.Errorf("error reading from iterator: %v", err)
+	var currentData map[uint32]ProcessData
+	var dropped uint64
+	if cfg.mode == "seq" {
+		data, err := collectSeqData(its)
+		if err != nil {
+			return nil, 0, err
+		}
+		currentData = data
+	} else {
+		// Reset the failed inserts counter of the previous run
+		if err := objs.FailedInserts.Set(uint64(0)); err != nil {
+			return nil, 0, fmt.Errorf("failed to reset failed_inserts: %v", err)
+		}
+
+		data, keys, err := collectCurrentData(its, objs)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Delete all keys in a batch
+		if _, err := objs.ProcessMap.BatchDelete(keys, nil); err != nil {
+			return nil, 0, fmt.Errorf("failed to batch delete keys: %v", err)
+		}
+		currentData = data
+
+		if err := objs.FailedInserts.Get(&dropped); err != nil {
+			return nil, 0, fmt.Errorf("failed to read failed_inserts: %v", err)
+		}
+		if dropped > 0 {
+			log.Printf("Warning: process_map is full (%d entries), %d processes were not counted, the results are truncated. Increase -max-procs",
+				cfg.maxProcs, dropped)
+		}
+	}
+
+	// /proc is only read for new processes
+	history.procs.resolve(currentData)
+
+	// Calculate usage data with deltas
+	usageData := calculateUsageData(currentData, history)
+
+	// Update stored data for next iteration
+	updateStoredData(history, currentData, collectedAt)
+
+	return usageData, dropped, nil
+}
+
+// collectCurrentData runs the iterators and collects current process data
+func collectCurrentData(its []*link.Iter, objs *cpuTimeObjects) (map[uint32]ProcessData, []uint32, error) {
+	for _, it := range its {
+		if err := runIter(it); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Collect current CPU times
@@ -199,17 +353,18 @@ func collectCurrentData(it *link.Iter, objs *cpuTimeObjects) (map[uint32]Process
 	for cpuIter.Next(&key, &value) {
 		keys = append(keys, key)
 
-		// Get executable path from /proc
-		executable := getExecutablePath(key)
-
-		// Convert command name from [16]byte to string, trimming NUL bytes
-		comm := trimNullBytes(value.Comm[:])
-
 		currentData[key] = ProcessData{
-			PID:        key,
-			CPUTime:    value.CpuTime,
-			Comm:       comm,
-			Executable: executable,
+			PID:       key,
+			CPUTime:   value.CpuTime,
+			StartTime: value.StartTime,
+			Ppid:      value.Ppid,
+			State:     value.State,
+			NrThreads: value.NrThreads,
+			CgroupID:  value.CgroupId,
+			ExeDev:    value.ExeDev,
+			ExeIno:    value.ExeIno,
+			// Convert command name from [16]byte to string, trimming NUL bytes
+			Comm: trimNullBytes(value.Comm[:]),
 		}
 	}
 
@@ -220,50 +375,26 @@ func collectCurrentData(it *link.Iter, objs *cpuTimeObjects) (map[uint32]Process
 	return currentData, keys, nil
 }
 
-// calculateUsageData calculates CPU usage with deltas
-func calculateUsageData(currentData, processData map[uint32]ProcessData, clkTck int64) []ProcessUsage {
-	var usageData []ProcessUsage
-
-	for pid, current := range currentData {
-		usage := ProcessUsage{
-			PID:        pid,
-			TotalTime:  float64(current.CPUTime) / float64(clkTck),
-			Comm:       current.Comm,
-			Executable: current.Executable,
-		}
-
-		// Calculate delta if we have previous data
-		if prev, exists := processData[pid]; exists {
-			cpuDelta := current.CPUTime - prev.LastTime
-			usage.CPUDelta = float64(cpuDelta) / float64(clkTck)
-		}
-
-		usageData = append(usageData, usage)
+// runIter runs the sum_cpu_time iterator, which has no output
+func runIter(it *link.Iter) error {
+	// Open iterator to run the iterator
+	iter, err := it.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open iterator: %v", err)
 	}
+	defer iter.Close()
 
-	// Sort by CPU delta (descending)
-	sort.Slice(usageData, func(i, j int) bool {
-		return usageData[i].CPUDelta > usageData[j].CPUDelta
-	})
-
-	return usageData
-}
-
-// updateStoredData updates the process data map for the next iteration
-func updateStoredData(processData map[uint32]ProcessData, currentData map[uint32]ProcessData) {
-	for pid, current := range currentData {
-		processData[pid] = ProcessData{
-			PID:        pid,
-			CPUTime:    current.CPUTime,
-			LastTime:   current.CPUTime,
-			Comm:       current.Comm,
-			Executable: current.Executable,
-		}
+	// Read to run the iterator (no output expected)
+	buf := make([]byte, 1)
+	_, err = iter.Read(buf)
+	if err != nil && !errors.Is(err, os.ErrClosed) && err.Error() != "EOF" {
+		return fmt.Errorf("error reading from iterator: %v", err)
 	}
+	return nil
 }
 
 // printResults displays the CPU usage results
-func printResults(usageData []ProcessUsage, count int, startedAt time.Time) {
+func printResults(usageData []ProcessUsage, count int, wide bool, dropped uint64, startedAt time.Time) {
 	limit := len(usageData)
 	if count > 0 {
 		limit = min(limit, count)
@@ -271,33 +402,49 @@ func printResults(usageData []ProcessUsage, count int, startedAt time.Time) {
 
 	fmt.Printf("\nCPU Usage (at %s):\n", startedAt.Format("15:04:05"))
 	fmt.Println("-----------------------------------------------------------------------------------------------")
-	fmt.Printf("%-7s %-15s %-15s %-20s %-30s\n", "PID", "CPU (last int)", "Total CPU Time", "Command", "Executable")
+	fmt.Printf("%-7s %-1s %-15s %-15s %-20s %-30s%s\n", "PID", "S", "CPU (last int)", "Total CPU Time", "Command", "Executable",
+		wideHeader(wide))
 	for _, process := range usageData[:limit] {
 		// Only show processes with non-zero CPU usage in this interval
 		// if process.CPUDelta > 0 {
-		fmt.Printf("%-7d %-15.2fs %-15.2fs %-20s %-30s\n",
+		fmt.Printf("%-7d %c %-15.2fs %-15.2fs %-20s %-30s%s\n",
 			process.PID,
+			process.State,
 			process.CPUDelta,
 			process.TotalTime,
 			truncateString(process.Comm, 20),
-			truncateString(process.Executable, 30))
+			truncateString(process.Executable, 30),
+			wideColumns(process, wide))
 		//}
 	}
 
-	duration := time.Since(startedAt)
-	fmt.Printf("----->>>------------------------- %d: %v ---------- <<< ------------\n", len(usageData), duration)
+	printFooter(len(usageData), dropped, startedAt)
 }
 
-// getExecutablePath returns the path to the executable of a process
-func getExecutablePath(pid uint32) string {
-	path := fmt.Sprintf("/proc/%d/exe", pid)
-	exe, err := os.Readlink(path)
-	if err != nil {
-		// Return empty string if we can't read the executable path
-		// This could happen for system processes or if we don't have permissions
+// wideHeader returns the header of the columns -wide adds
+func wideHeader(wide bool) string {
+	if !wide {
 		return ""
 	}
-	return exe
+	return fmt.Sprintf(" %-40s %s", "Cgroup", "Command line")
+}
+
+// wideColumns returns the columns -wide adds for process
+func wideColumns(process ProcessUsage, wide bool) string {
+	if !wide {
+		return ""
+	}
+	return fmt.Sprintf(" %-40s %s", truncateString(process.Cgroup, 40), process.Cmdline)
+}
+
+// printFooter prints the number of processes and the time taken by the collection
+func printFooter(procs int, dropped uint64, startedAt time.Time) {
+	duration := time.Since(startedAt)
+	if dropped > 0 {
+		fmt.Printf("----->>>------------------------- %d (+%d dropped): %v ---------- <<< ------------\n", procs, dropped, duration)
+		return
+	}
+	fmt.Printf("----->>>------------------------- %d: %v ---------- <<< ------------\n", procs, duration)
 }
 
 // truncateString truncates a string to the given length and adds "..." if it was truncated
@@ -320,3 +467,15 @@ func trimNullBytes(b []int8) string {
 	}
 	return sb.String()
 }
+
+// taskState returns the state letter /proc/<pid>/stat shows for a kernel task state
+func taskState(state uint32) byte {
+	const (
+		taskReport = 0x7f  // states reported to userspace
+		taskIdle   = 0x402 // TASK_UNINTERRUPTIBLE | TASK_NOLOAD
+	)
+	if state == taskIdle {
+		return 'I'
+	}
+	return "RSDTtXZP"[bits.Len32(state&taskReport)]
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// procKey identifies a process over its lifetime, as pids are reused
+type procKey struct {
+	pid       uint32
+	startTime uint64
+}
+
+// procInfo holds what is read from /proc about a process
+type procInfo struct {
+	key procKey
+	// comm and executable inode the entry was read with, an exec changes them
+	comm   string
+	exeDev uint32
+	exeIno uint64
+
+	exe     string
+	cmdline string
+	cgroup  string
+}
+
+// procCache is an LRU cache of procInfo, so /proc is read once per
+// process lifetime instead of once per process per collection
+type procCache struct {
+	size    int
+	entries map[procKey]*list.Element
+	lru     *list.List // of *procInfo, most recently used first
+	read    func(pid uint32) (procInfo, error)
+}
+
+func newProcCache(size int) *procCache {
+	return &procCache{
+		size:    size,
+		entries: make(map[procKey]*list.Element),
+		lru:     list.New(),
+		read:    readProcInfo,
+	}
+}
+
+// resolve sets the Executable, Cmdline and Cgroup of the processes in data
+func (c *procCache) resolve(data map[uint32]ProcessData) {
+	for pid, process := range data {
+		info := c.get(process)
+		process.Executable = info.exe
+		process.Cmdline = info.cmdline
+		process.Cgroup = info.cgroup
+		data[pid] = process
+	}
+}
+
+// get returns the procInfo of process, reading /proc on a miss. A failed
+// read is not cached, the process may still be starting or be gone.
+func (c *procCache) get(process ProcessData) *procInfo {
+	key := procKey{pid: process.PID, startTime: process.StartTime}
+	if e, ok := c.entries[key]; ok {
+		info := e.Value.(*procInfo)
+		// An exec keeps the pid and start time, but not the comm and executable
+		if info.comm == process.Comm && info.exeDev == process.ExeDev && info.exeIno == process.ExeIno {
+			c.lru.MoveToFront(e)
+			return info
+		}
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+
+	info, err := c.read(process.PID)
+	info.key = key
+	info.comm = process.Comm
+	info.exeDev = process.ExeDev
+	info.exeIno = process.ExeIno
+	if err != nil {
+		return &info
+	}
+	c.entries[key] = c.lru.PushFront(&info)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*procInfo).key)
+	}
+	return &info
+}
+
+// readProcInfo reads the executable, command line and cgroup of pid from /proc.
+// Whatever cannot be read, e.g. because the process exited, is left empty,
+// and the error tells the command line or cgroup could not be read. Kernel
+// threads have no executable, its absence is no error.
+func readProcInfo(pid uint32) (procInfo, error) {
+	info := procInfo{exe: getExecutablePath(pid)}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return info, err
+	}
+	info.cmdline = parseCmdline(data)
+	data, err = os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return info, err
+	}
+	info.cgroup = parseCgroup(data)
+	return info, nil
+}
+
+// getExecutablePath returns the path to the executable of a process
+func getExecutablePath(pid uint32) string {
+	path := fmt.Sprintf("/proc/%d/exe", pid)
+	exe, err := os.Readlink(path)
+	if err != nil {
+		// Return empty string if we can't read the executable path
+		// This could happen for system processes or if we don't have permissions
+		return ""
+	}
+	return exe
+}
+
+// parseCmdline joins the NUL separated arguments of /proc/<pid>/cmdline
+func parseCmdline(data []byte) string {
+	data = bytes.TrimRight(data, "\x00")
+	return string(bytes.ReplaceAll(data, []byte{0}, []byte{' '}))
+}
+
+// parseCgroup returns the cgroup v2 path of /proc/<pid>/cgroup, or the
+// path of the first hierarchy on cgroup v1 only hosts
+func parseCgroup(data []byte) string {
+	var first string
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			return fields[2]
+		}
+		if first == "" {
+			first = fields[2]
+		}
+	}
+	return first
+}
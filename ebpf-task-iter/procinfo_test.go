@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func Test_procCache(t *testing.T) {
+	reads := 0
+	c := newProcCache(2)
+	c.read = func(pid uint32) (procInfo, error) {
+		reads++
+		if pid == 12 {
+			return procInfo{}, fs.ErrNotExist
+		}
+		return procInfo{exe: fmt.Sprintf("/bin/exe%d-%d", pid, reads)}, nil
+	}
+
+	shell := ProcessData{PID: 10, StartTime: 100, Comm: "sh", ExeDev: 1, ExeIno: 20}
+	tests := []struct {
+		name      string
+		process   ProcessData
+		wantExe   string
+		wantReads int
+	}{
+		{name: "miss", process: shell, wantExe: "/bin/exe10-1", wantReads: 1},
+		{name: "hit", process: shell, wantExe: "/bin/exe10-1", wantReads: 1},
+		{
+			name:      "exec",
+			process:   ProcessData{PID: 10, StartTime: 100, Comm: "make", ExeDev: 1, ExeIno: 21},
+			wantExe:   "/bin/exe10-2",
+			wantReads: 2,
+		},
+		{
+			name:      "pid reused",
+			process:   ProcessData{PID: 10, StartTime: 200, Comm: "make", ExeDev: 1, ExeIno: 21},
+			wantExe:   "/bin/exe10-3",
+			wantReads: 3,
+		},
+		{
+			name:      "evicts least recently used",
+			process:   ProcessData{PID: 11, StartTime: 300, Comm: "cc", ExeDev: 1, ExeIno: 22},
+			wantExe:   "/bin/exe11-4",
+			wantReads: 4,
+		},
+		{
+			name:      "evicted entry is read again",
+			process:   ProcessData{PID: 10, StartTime: 100, Comm: "make", ExeDev: 1, ExeIno: 21},
+			wantExe:   "/bin/exe10-5",
+			wantReads: 5,
+		},
+		{
+			name:      "failed read",
+			process:   ProcessData{PID: 12, StartTime: 400, Comm: "cc", ExeDev: 1, ExeIno: 22},
+			wantExe:   "",
+			wantReads: 6,
+		},
+		{
+			name:      "failed read is not cached",
+			process:   ProcessData{PID: 12, StartTime: 400, Comm: "cc", ExeDev: 1, ExeIno: 22},
+			wantExe:   "",
+			wantReads: 7,
+		},
+	}
+	for _, tt := range tests {
+		info := c.get(tt.process)
+		if info.exe != tt.wantExe || reads != tt.wantReads {
+			t.Errorf("%s: get() exe = %q after %d reads, want %q after %d reads", tt.name, info.exe, reads, tt.wantExe, tt.wantReads)
+		}
+		if c.lru.Len() != len(c.entries) || c.lru.Len() > c.size {
+			t.Errorf("%s: %d lru entries and %d map entries, size %d", tt.name, c.lru.Len(), len(c.entries), c.size)
+		}
+	}
+}
+
+func Test_parseCgroup(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "v2",
+			data: "0::/system.slice/sshd.service\n",
+			want: "/system.slice/sshd.service",
+		},
+		{
+			name: "hybrid",
+			data: "12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n0::/user.slice/user-1000.slice/session-2.scope\n",
+			want: "/user.slice/user-1000.slice/session-2.scope",
+		},
+		{
+			name: "v1",
+			data: "12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n",
+			want: "/user.slice",
+		},
+		{
+			name: "empty",
+			data: "",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCgroup([]byte(tt.data)); got != tt.want {
+				t.Errorf("parseCgroup() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseCmdline(t *testing.T) {
+	if got, want := parseCmdline([]byte("sleep\x00100\x00")), "sleep 100"; got != want {
+		t.Errorf("parseCmdline() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// taskRecordSize is the size of struct task_record written by dump_cpu_time
+const taskRecordSize = int(unsafe.Sizeof(cpuTimeTaskRecord{}))
+
+// collectSeqData runs the dump_cpu_time iterators and sums the task records
+// they write per process. Unlike collectCurrentData there is no map, so no
+// limit on the number of processes and nothing to delete afterwards.
+func collectSeqData(its []*link.Iter) (map[uint32]ProcessData, error) {
+	currentData := make(map[uint32]ProcessData)
+	for _, it := range its {
+		if err := readTaskRecords(it, currentData); err != nil {
+			return nil, err
+		}
+	}
+	return currentData, nil
+}
+
+// readTaskRecords runs the dump_cpu_time iterator it and adds the task
+// records to currentData
+func readTaskRecords(it *link.Iter, currentData map[uint32]ProcessData) error {
+	iter, err := it.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open iterator: %v", err)
+	}
+	defer iter.Close()
+
+	r := bufio.NewReaderSize(iter, 64*taskRecordSize)
+	buf := make([]byte, taskRecordSize)
+	var rec cpuTimeTaskRecord
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading from iterator: %v", err)
+		}
+		decodeTaskRecord(buf, &rec)
+
+		data, exists := currentData[rec.Tgid]
+		if !exists {
+			data = ProcessData{
+				PID:       rec.Tgid,
+				StartTime: rec.StartTime,
+				Ppid:      rec.Ppid,
+				State:     rec.State,
+				NrThreads: rec.NrThreads,
+				CgroupID:  rec.CgroupId,
+				ExeDev:    rec.ExeDev,
+				ExeIno:    rec.ExeIno,
+			}
+		}
+		data.CPUTime += rec.CpuTime
+		// the thread group leader names the process
+		if !exists || rec.Pid == rec.Tgid {
+			data.Comm = trimNullBytes(rec.Comm[:])
+		}
+		currentData[rec.Tgid] = data
+	}
+}
+
+// decodeTaskRecord decodes buf into rec.
+// Must match the C struct task_record from the BPF program
+func decodeTaskRecord(buf []byte, rec *cpuTimeTaskRecord) {
+	rec.Tgid = binary.NativeEndian.Uint32(buf[0:4])
+	rec.Pid = binary.NativeEndian.Uint32(buf[4:8])
+	rec.CpuTime = binary.NativeEndian.Uint64(buf[8:16])
+	rec.StartTime = binary.NativeEndian.Uint64(buf[16:24])
+	rec.Ppid = binary.NativeEndian.Uint32(buf[24:28])
+	rec.State = binary.NativeEndian.Uint32(buf[28:32])
+	rec.NrThreads = binary.NativeEndian.Uint32(buf[32:36])
+	rec.ExeDev = binary.NativeEndian.Uint32(buf[36:40])
+	rec.CgroupId = binary.NativeEndian.Uint64(buf[40:48])
+	rec.ExeIno = binary.NativeEndian.Uint64(buf[48:56])
+	for i := range rec.Comm {
+		rec.Comm[i] = int8(buf[56+i])
+	}
+}
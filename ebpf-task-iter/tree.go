@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// processTree links the processes of a collection to their parents
+type processTree struct {
+	procs    map[uint32]ProcessUsage
+	children map[uint32][]uint32
+	// Processes whose parent was not collected: init, kthreadd, or
+	// processes whose parent exited during the collection
+	roots []uint32
+	// CPU delta of every process and its descendants
+	treeDelta map[uint32]float64
+}
+
+// newProcessTree builds the process tree of usageData
+func newProcessTree(usageData []ProcessUsage) *processTree {
+	t := &processTree{
+		procs:     make(map[uint32]ProcessUsage, len(usageData)),
+		children:  make(map[uint32][]uint32),
+		treeDelta: make(map[uint32]float64, len(usageData)),
+	}
+	for _, process := range usageData {
+		t.procs[process.PID] = process
+	}
+	for _, process := range usageData {
+		if _, ok := t.procs[process.Ppid]; ok && process.Ppid != process.PID {
+			t.children[process.Ppid] = append(t.children[process.Ppid], process.PID)
+		} else {
+			t.roots = append(t.roots, process.PID)
+		}
+	}
+	for _, root := range t.roots {
+		t.sumDelta(root)
+	}
+	// Busiest subtrees first
+	byDelta := func(pids []uint32) {
+		sort.Slice(pids, func(i, j int) bool {
+			if t.treeDelta[pids[i]] != t.treeDelta[pids[j]] {
+				return t.treeDelta[pids[i]] > t.treeDelta[pids[j]]
+			}
+			return pids[i] < pids[j]
+		})
+	}
+	byDelta(t.roots)
+	for _, children := range t.children {
+		byDelta(children)
+	}
+	return t
+}
+
+// sumDelta fills treeDelta of pid and its descendants
+func (t *processTree) sumDelta(pid uint32) float64 {
+	sum := t.procs[pid].CPUDelta
+	for _, child := range t.children[pid] {
+		sum += t.sumDelta(child)
+	}
+	t.treeDelta[pid] = sum
+	return sum
+}
+
+// walk calls fn for every process depth first, with its depth in the tree
+func (t *processTree) walk(fn func(process ProcessUsage, depth int) bool) {
+	var visit func(pid uint32, depth int) bool
+	visit = func(pid uint32, depth int) bool {
+		if !fn(t.procs[pid], depth) {
+			return false
+		}
+		for _, child := range t.children[pid] {
+			if !visit(child, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, root := range t.roots {
+		if !visit(root, 0) {
+			return
+		}
+	}
+}
+
+// printTree displays the CPU usage results as a process tree
+func printTree(usageData []ProcessUsage, count int, wide bool, dropped uint64, startedAt time.Time) {
+	tree := newProcessTree(usageData)
+
+	fmt.Printf("\nCPU Usage (at %s):\n", startedAt.Format("15:04:05"))
+	fmt.Println("-----------------------------------------------------------------------------------------------")
+	fmt.Printf("%-7s %-1s %-15s %-15s %-30s %-30s%s\n", "PID", "S", "CPU (last int)", "CPU (tree)", "Command", "Executable",
+		wideHeader(wide))
+	lines := 0
+	tree.walk(func(process ProcessUsage, depth int) bool {
+		if count > 0 && lines == count {
+			return false
+		}
+		lines++
+		fmt.Printf("%-7d %c %-15.2fs %-15.2fs %-30s %-30s%s\n",
+			process.PID,
+			process.State,
+			process.CPUDelta,
+			tree.treeDelta[process.PID],
+			truncateString(strings.Repeat("  ", min(depth, 5))+process.Comm, 30),
+			truncateString(process.Executable, 30),
+			wideColumns(process, wide))
+		return true
+	})
+
+	printFooter(len(usageData), dropped, startedAt)
+}
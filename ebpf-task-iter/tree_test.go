@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_processTree(t *testing.T) {
+	usageData := []ProcessUsage{
+		{PID: 1, Ppid: 0, CPUDelta: 0.1, Comm: "systemd"},
+		{PID: 2, Ppid: 0, CPUDelta: 0, Comm: "kthreadd"},
+		{PID: 3, Ppid: 2, CPUDelta: 0.2, Comm: "kworker"},
+		{PID: 10, Ppid: 1, CPUDelta: 0, Comm: "bash"},
+		{PID: 11, Ppid: 10, CPUDelta: 0.5, Comm: "make"},
+		{PID: 12, Ppid: 11, CPUDelta: 1, Comm: "cc"},
+		{PID: 20, Ppid: 1, CPUDelta: 0.3, Comm: "sshd"},
+		// parent exited
+		{PID: 30, Ppid: 29, CPUDelta: 0.4, Comm: "orphan"},
+	}
+	tree := newProcessTree(usageData)
+
+	wantDelta := map[uint32]float64{1: 1.9, 2: 0.2, 3: 0.2, 10: 1.5, 11: 1.5, 12: 1, 20: 0.3, 30: 0.4}
+	for pid, want := range wantDelta {
+		if got := tree.treeDelta[pid]; got < want-1e-9 || got > want+1e-9 {
+			t.Errorf("treeDelta[%d] = %v, want %v", pid, got, want)
+		}
+	}
+
+	type line struct {
+		pid   uint32
+		depth int
+	}
+	var got []line
+	tree.walk(func(process ProcessUsage, depth int) bool {
+		got = append(got, line{process.PID, depth})
+		return true
+	})
+	want := []line{{1, 0}, {10, 1}, {11, 2}, {12, 3}, {20, 1}, {30, 0}, {2, 0}, {3, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walk() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// task_struct utime and stime are in ns
+const nsPerSecond = 1e9
+
+// History holds the process data of the previous collection
+type History struct {
+	Processes map[uint32]ProcessData
+	// CLOCK_MONOTONIC time in ns of the previous collection, 0 before the first one
+	CollectedAt uint64
+
+	procs *procCache
+}
+
+// NewHistory returns an empty History, caching /proc data of up to cacheSize processes
+func NewHistory(cacheSize int) *History {
+	return &History{
+		Processes: make(map[uint32]ProcessData),
+		procs:     newProcCache(cacheSize),
+	}
+}
+
+// monotonicNow returns the CLOCK_MONOTONIC time in ns, the clock of task start_time
+func monotonicNow() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, fmt.Errorf("failed to read CLOCK_MONOTONIC: %v", err)
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// cpuDelta returns the CPU time in ns current used since the previous collection
+func cpuDelta(current ProcessData, history *History) uint64 {
+	prev, exists := history.Processes[current.PID]
+	switch {
+	case exists && prev.StartTime == current.StartTime:
+		// The sum includes the exited threads, but a thread exiting
+		// while the iterator runs may be counted both in the main
+		// thread and on its own, then the sum drops at the next
+		// collection. The drop is reported as no CPU time rather
+		// than wrapping around.
+		if current.CPUTime < prev.CPUTime {
+			return 0
+		}
+		return current.CPUTime - prev.CPUTime
+	case history.CollectedAt != 0 && current.StartTime >= history.CollectedAt:
+		// Started after the previous collection (possibly on a reused pid),
+		// all of its CPU time was used in this interval
+		return current.CPUTime
+	default:
+		// No baseline yet
+		return 0
+	}
+}
+
+// calculateUsageData calculates CPU usage with deltas
+func calculateUsageData(currentData map[uint32]ProcessData, history *History) []ProcessUsage {
+	var usageData []ProcessUsage
+
+	for pid, current := range currentData {
+		usageData = append(usageData, ProcessUsage{
+			PID:        pid,
+			Ppid:       current.Ppid,
+			State:      taskState(current.State),
+			CPUDelta:   float64(cpuDelta(current, history)) / nsPerSecond,
+			TotalTime:  float64(current.CPUTime) / nsPerSecond,
+			Comm:       current.Comm,
+			Executable: current.Executable,
+			Cmdline:    current.Cmdline,
+			Cgroup:     current.Cgroup,
+		})
+	}
+
+	// Sort by CPU delta (descending)
+	sort.Slice(usageData, func(i, j int) bool {
+		if usageData[i].CPUDelta != usageData[j].CPUDelta {
+			return usageData[i].CPUDelta > usageData[j].CPUDelta
+		}
+		return usageData[i].PID < usageData[j].PID
+	})
+
+	return usageData
+}
+
+// updateStoredData replaces the history with the data collected at collectedAt.
+// Exited processes are dropped, so their pids can be reused.
+func updateStoredData(history *History, currentData map[uint32]ProcessData, collectedAt uint64) {
+	history.Processes = currentData
+	history.CollectedAt = collectedAt
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// previous collection at 100s, cpu times in ns
+var testHistory = &History{
+	Processes: map[uint32]ProcessData{
+		10: {PID: 10, CPUTime: 2_000_000_000, StartTime: 5_000_000_000, Comm: "busy"},
+		11: {PID: 11, CPUTime: 3_000_000_000, StartTime: 5_000_000_000, Comm: "threads"},
+		12: {PID: 12, CPUTime: 1_000_000_000, StartTime: 6_000_000_000, Comm: "old"},
+	},
+	CollectedAt: 100_000_000_000,
+}
+
+func Test_cpuDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		current ProcessData
+		history *History
+		want    uint64
+	}{
+		{
+			name:    "same process",
+			current: ProcessData{PID: 10, CPUTime: 2_500_000_000, StartTime: 5_000_000_000},
+			history: testHistory,
+			want:    500_000_000,
+		},
+		{
+			name:    "idle process",
+			current: ProcessData{PID: 10, CPUTime: 2_000_000_000, StartTime: 5_000_000_000},
+			history: testHistory,
+			want:    0,
+		},
+		{
+			name:    "thread counted twice by the previous collection",
+			current: ProcessData{PID: 11, CPUTime: 1_000_000_000, StartTime: 5_000_000_000},
+			history: testHistory,
+			want:    0,
+		},
+		{
+			name:    "pid reused",
+			current: ProcessData{PID: 12, CPUTime: 300_000_000, StartTime: 100_500_000_000},
+			history: testHistory,
+			want:    300_000_000,
+		},
+		{
+			name:    "new process",
+			current: ProcessData{PID: 20, CPUTime: 700_000_000, StartTime: 100_000_000_000},
+			history: testHistory,
+			want:    700_000_000,
+		},
+		{
+			name:    "missed by the previous collection",
+			current: ProcessData{PID: 21, CPUTime: 700_000_000, StartTime: 50_000_000_000},
+			history: testHistory,
+			want:    0,
+		},
+		{
+			name:    "first collection",
+			current: ProcessData{PID: 10, CPUTime: 2_000_000_000, StartTime: 5_000_000_000},
+			history: NewHistory(16),
+			want:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cpuDelta(tt.current, tt.history); got != tt.want {
+				t.Errorf("cpuDelta() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_calculateUsageData(t *testing.T) {
+	currentData := map[uint32]ProcessData{
+		10: {PID: 10, Ppid: 1, State: 1, CPUTime: 2_500_000_000, StartTime: 5_000_000_000, Comm: "busy"},
+		12: {PID: 12, Ppid: 10, State: 0, CPUTime: 300_000_000, StartTime: 100_500_000_000, Comm: "new"},
+		13: {PID: 13, Ppid: 10, State: 0x20, CPUTime: 1_500_000_000, StartTime: 101_000_000_000, Comm: "short"},
+	}
+	want := []ProcessUsage{
+		{PID: 13, Ppid: 10, State: 'Z', CPUDelta: 1.5, TotalTime: 1.5, Comm: "short"},
+		{PID: 10, Ppid: 1, State: 'S', CPUDelta: 0.5, TotalTime: 2.5, Comm: "busy"},
+		{PID: 12, Ppid: 10, State: 'R', CPUDelta: 0.3, TotalTime: 0.3, Comm: "new"},
+	}
+	if got := calculateUsageData(currentData, testHistory); !reflect.DeepEqual(got, want) {
+		t.Errorf("calculateUsageData() = %v, want %v", got, want)
+	}
+}
+
+func Test_updateStoredData(t *testing.T) {
+	history := NewHistory(16)
+	currentData := map[uint32]ProcessData{
+		10: {PID: 10, CPUTime: 2_500_000_000, StartTime: 5_000_000_000, Comm: "busy"},
+	}
+	updateStoredData(history, currentData, 101_000_000_000)
+	if history.CollectedAt != 101_000_000_000 {
+		t.Errorf("CollectedAt = %v, want %v", history.CollectedAt, 101_000_000_000)
+	}
+	if !reflect.DeepEqual(history.Processes, currentData) {
+		t.Errorf("Processes = %v, want %v", history.Processes, currentData)
+	}
+}
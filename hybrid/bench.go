@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/bench"
+)
+
+// benchStrategy is the strategy label of the bench result
+func benchStrategy(strategy string) string {
+	if strategy == strategyProc {
+		return "hybrid"
+	}
+	return "hybrid-" + strategy
+}
+
+// runBench measures the cost of every collection tick
+func runBench(ctx context.Context, s *session, ticks int, jsonFile string) error {
+	c := newCollector(s.src, s.isolatedCPUs, s.strategy)
+	samples := make([]bench.Sample, 0, ticks)
+	procs := make([]int, 0, ticks)
+	err := s.loop(ctx, func(ts, startedAt time.Time) bool {
+		m := bench.Start()
+		res := c.collect(ts)
+		samples = append(samples, m.Stop())
+		procs = append(procs, res.procsRead)
+		return len(samples) < ticks
+	})
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no ticks measured")
+	}
+
+	result := bench.NewResult(toolName, benchStrategy(s.strategy), s.interval, samples, procs)
+	result.Print(os.Stdout)
+	if jsonFile != "" {
+		if err := result.WriteJSON(jsonFile); err != nil {
+			return fmt.Errorf("cannot write %s: %w", jsonFile, err)
+		}
+		log.Info("Bench result written", "file", jsonFile)
+	}
+	return nil
+}
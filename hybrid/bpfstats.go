@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+)
+
+type progStatsGetter interface {
+	ProgStats() (ebpf.ProgStats, error)
+}
+
+// bpfStats reports the kernel overhead of the ebpf program between ticks
+type bpfStats struct {
+	bpf    progStatsGetter
+	last   ebpf.ProgStats
+	lastTs time.Time
+}
+
+// interval returns log attributes of the program runs since the previous tick
+func (b *bpfStats) interval(ts time.Time) []any {
+	stats, err := b.bpf.ProgStats()
+	if err != nil {
+		return []any{"bpf-error", err}
+	}
+	defer func() {
+		b.last, b.lastTs = stats, ts
+	}()
+	if b.lastTs.IsZero() {
+		return nil
+	}
+	runs := stats.RunCount - b.last.RunCount
+	runTime := stats.RunTime - b.last.RunTime
+	var avg time.Duration
+	if runs > 0 {
+		avg = runTime / time.Duration(runs)
+	}
+	// share of all the cpu time of the host in the interval
+	available := ts.Sub(b.lastTs) * time.Duration(runtime.NumCPU())
+	return []any{
+		"bpf-runs", runs,
+		"bpf-avg", avg.String(),
+		"bpf-time", runTime.String(),
+		"bpf-overhead", fmt.Sprintf("%.4f%%", 100*float64(runTime)/float64(available)),
+	}
+}
+
+type failedInsertsGetter interface {
+	FailedInserts() (ebpf.FailedInserts, error)
+}
+
+// failedInserts warns when threads were not measured because a map of the
+// ebpf program was full
+type failedInserts struct {
+	bpf  failedInsertsGetter
+	last ebpf.FailedInserts
+}
+
+func newFailedInserts(bpf failedInsertsGetter) *failedInserts {
+	f := &failedInserts{bpf: bpf}
+	// counted by a pinned program before this run
+	f.last, _ = bpf.FailedInserts()
+	return f
+}
+
+// check warns about the failed inserts since the previous check
+func (f *failedInserts) check() {
+	counts, err := f.bpf.FailedInserts()
+	if err != nil {
+		log.Error("cannot read failed inserts", "error", err)
+		return
+	}
+	if n := counts.RunqEnqueued - f.last.RunqEnqueued; n > 0 {
+		log.Warn("runq_enqueued full, run queue latency under-reported", "failed-inserts", n)
+	}
+	if n := counts.OffCPUSince - f.last.OffCPUSince; n > 0 {
+		log.Warn("off_cpu_since full, off-cpu time under-reported", "failed-inserts", n)
+	}
+	f.last = counts
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/isolated"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/proctable"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/record"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/tree"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+// strategies to read the cpu time of active processes
+const (
+	strategyProc     = "proc"      // read /proc/<pid>/stat of each
+	strategyTaskIter = "task-iter" // run a task iterator over them, no /proc I/O
+	strategySyscall  = "syscall"   // look each up in one run of a syscall program, no /proc I/O
+	strategyAllProc  = "allproc"   // no ebpf, read /proc/<pid>/stat of every process
+	strategyAuto     = "auto"      // the cheapest of the above the kernel supports
+)
+
+// collector carries the state of the hybrid approach between ticks
+type collector struct {
+	src          record.Source
+	isolatedCPUs []CPUId
+	strategy     string
+	tracker      *usage.Tracker
+	lastCpuTicks proc.CpuTicks
+	// procs is the process table kept with --proc-events, the processes
+	// started before it are added when read
+	procs *proctable.Table
+	// roots rolls the cpu time up to ancestors with --rollup, and units
+	// aggregates it by systemd unit with --units, both with the cpu time of
+	// the exited processes when procs keeps their exits
+	roots *tree.Roots
+	units *systemd.Resolver
+}
+
+// tickResult summarizes one collection tick
+type tickResult struct {
+	procsRead int
+	// context switches of the active processes, from ebpf
+	switches            uint64
+	involuntarySwitches uint64
+	// offCPU is the time the active processes spent off cpu, with --off-cpu
+	offCPU      ebpf.OffCPU
+	offCPUProcs ebpf.ActiveProcs
+	deltas      []usage.Delta
+	// exited are the deltas of the processes which exited since the
+	// previous tick, with --rollup or --units and --proc-events
+	exited []usage.Delta
+	// rollup is the cpu time of deltas and exited by root, with --rollup
+	rollup []tree.RootUsage
+	// units is the cpu time of deltas and exited by systemd unit, with --units
+	units     []systemd.Usage
+	hostTicks proc.CpuTicks
+	// uptime is the time since boot of the tick
+	uptime proc.CpuTicks
+}
+
+func (r tickResult) cpuSeconds() float64 {
+	return ticksToSeconds(usage.Sum(r.deltas))
+}
+
+func (r tickResult) hostCpuSeconds() float64 {
+	return ticksToSeconds(r.hostTicks)
+}
+
+func ticksToSeconds(ticks proc.CpuTicks) float64 {
+	return float64(ticks) / proc.UserHZ
+}
+
+func newCollector(src record.Source, isolatedCPUs []CPUId, strategy string) *collector {
+	log.Info("Isolated CPUs", "num", len(isolatedCPUs), "cpus", isolatedCPUs)
+	isolated.Init(isolatedCPUs)
+	return &collector{
+		src:          src,
+		isolatedCPUs: isolatedCPUs,
+		strategy:     strategy,
+		tracker:      usage.NewTracker(),
+	}
+}
+
+func (c *collector) collect(ts time.Time) tickResult {
+	res := tickResult{}
+	// the final cpu time of exited processes, before their pid is reused
+	if c.tracksExits() {
+		for _, ev := range c.procs.TakeExits() {
+			res.exited = append(res.exited, c.tracker.Exited(proc.PidStat{
+				Pid:       ev.Pid,
+				Comm:      ev.Comm,
+				Ppid:      ev.Ppid,
+				Session:   ev.Session,
+				Utime:     proc.NsToTicks(ev.Runtime),
+				StartTime: proc.NsToTicks(ev.StartTime),
+			}))
+		}
+	}
+	// get active procs from ebpf
+	activeProcs, err := c.activeProcs()
+	if err != nil {
+		log.Error("Error reading active procs", "error", err)
+	}
+	var procs ebpf.ActiveProcs
+	for _, activeProc := range activeProcs {
+		// a process which ran on housekeeping and isolated cpus is tracked
+		// on the isolated ones, as it may keep running there without switch
+		var onIsolated []CPUId
+		for _, cpu := range activeProc.AllCpus() {
+			if slices.Contains(c.isolatedCPUs, cpu) {
+				isolated.StartTracking(cpu, activeProc)
+				onIsolated = append(onIsolated, cpu)
+			}
+		}
+		res.switches += activeProc.VoluntarySwitches + activeProc.InvoluntarySwitches
+		res.involuntarySwitches += activeProc.InvoluntarySwitches
+		if activeProc.OffCPU.Total() > 0 {
+			res.offCPU.Add(activeProc.OffCPU)
+			res.offCPUProcs = append(res.offCPUProcs, activeProc)
+		}
+		if onIsolated != nil && activeProc.InvoluntarySwitches > 0 {
+			log.Info("Preempted on isolated cpus", "pid", activeProc.Pid, "comm", activeProc.Comm,
+				"cpus", onIsolated, "involuntary", activeProc.InvoluntarySwitches, "voluntary", activeProc.VoluntarySwitches)
+		}
+		if onIsolated == nil && !*onlyIsolated {
+			procs = append(procs, activeProc)
+		}
+	}
+	// get active procs from isolated cpus, but the ones which only ran on
+	// housekeeping cpus in this interval
+	isolatedActiveProcs := slices.DeleteFunc(isolated.ActiveProcs(), func(p ebpf.ActiveProc) bool {
+		return slices.ContainsFunc(procs, func(q ebpf.ActiveProc) bool { return q.Pid == p.Pid })
+	})
+
+	read := c.readStats(append(slices.Clone(procs), isolatedActiveProcs...))
+	stats := make([]proc.PidStat, 0, len(read))
+	for _, activeProc := range procs {
+		stat, ok := read[activeProc.Pid]
+		if !ok {
+			log.Error("cannot read cpu time", "strategy", c.strategy, "proc", activeProc)
+			c.forget(activeProc.Pid)
+		} else {
+			stats = append(stats, stat)
+		}
+	}
+	for _, isolatedActiveProc := range isolatedActiveProcs {
+		stat, ok := read[isolatedActiveProc.Pid]
+		if !ok {
+			log.Error("cannot read cpu time", "strategy", c.strategy, "proc", isolatedActiveProc)
+			isolated.RemoveTracking(isolatedActiveProc.Pid)
+			c.forget(isolatedActiveProc.Pid)
+		} else {
+			stats = append(stats, stat)
+		}
+	}
+	res.procsRead = len(stats)
+	if c.procs != nil {
+		for _, stat := range stats {
+			c.procs.Seen(proctable.Proc{
+				Pid:       stat.Pid,
+				Ppid:      stat.Ppid,
+				Session:   stat.Session,
+				Comm:      stat.Comm,
+				StartTime: uint64(stat.StartTime) * (1e9 / proc.UserHZ),
+			})
+		}
+	}
+
+	// /proc/stat gives the host cpu usage and the boot time
+	hostTicks, uptime, err := c.readCpuStat(ts)
+	if err != nil {
+		log.Error("cannot read /proc/stat", "error", err)
+	}
+	res.hostTicks = hostTicks
+	res.uptime = uptime
+	res.deltas = c.tracker.Update(uptime, stats)
+	if c.roots != nil {
+		res.rollup = c.rollUp(res.deltas, res.exited)
+	}
+	if c.units != nil {
+		res.units = systemd.Aggregate(c.units, res.deltas, res.exited)
+	}
+	return res
+}
+
+// tracksExits tells if the cpu time of exited processes is accounted
+func (c *collector) tracksExits() bool {
+	return (c.roots != nil || c.units != nil) && c.procs != nil
+}
+
+// forget drops the baseline of a process which could not be read, unless
+// its exit event accounts it
+func (c *collector) forget(pid Pid) {
+	if c.tracksExits() {
+		return
+	}
+	c.tracker.Forget(pid)
+	if c.units != nil {
+		c.units.Forget(pid)
+	}
+}
+
+// rollUp returns the cpu time of deltas and exited by root. The ancestors
+// which did not run are looked up in the process table, else read from
+// /proc.
+func (c *collector) rollUp(deltas, exited []usage.Delta) []tree.RootUsage {
+	t := tree.New(func(pid Pid) (tree.Node, bool) {
+		if c.procs != nil {
+			if p, ok := c.procs.Get(pid); ok {
+				return tree.Node{Pid: p.Pid, Ppid: p.Ppid, Session: p.Session, Comm: p.Comm}, true
+			}
+		}
+		stat, err := c.readPidStat(pid)
+		if err != nil {
+			return tree.Node{}, false
+		}
+		return nodeOf(stat), true
+	})
+	for _, d := range deltas {
+		t.Add(nodeOf(d.PidStat))
+	}
+	for _, d := range exited {
+		t.Add(nodeOf(d.PidStat))
+	}
+	return tree.RollUp(t, *c.roots, deltas, exited)
+}
+
+func nodeOf(stat proc.PidStat) tree.Node {
+	return tree.Node{Pid: stat.Pid, Ppid: stat.Ppid, Session: stat.Session, Comm: stat.Comm}
+}
+
+// activeProcs returns the processes to read, every process of /proc for allproc
+func (c *collector) activeProcs() (ebpf.ActiveProcs, error) {
+	if c.strategy != strategyAllProc {
+		return c.src.ActiveProcs()
+	}
+	pids, err := c.src.Pids()
+	procs := make(ebpf.ActiveProcs, len(pids))
+	for i, pid := range pids {
+		// the cpu is unknown without ebpf, none is isolated
+		procs[i] = ebpf.ActiveProc{Pid: pid, Cpu: -1}
+	}
+	return procs, err
+}
+
+// readStats returns the stats of procs which could be read, by pid
+func (c *collector) readStats(procs ebpf.ActiveProcs) map[Pid]proc.PidStat {
+	stats := make(map[Pid]proc.PidStat, len(procs))
+	if c.strategy != strategyProc && c.strategy != strategyAllProc {
+		pids := make([]Pid, len(procs))
+		for i, activeProc := range procs {
+			pids[i] = activeProc.Pid
+		}
+		times, err := c.src.ProcTimes(pids)
+		if err != nil {
+			log.Error("cannot read cpu times in the kernel", "strategy", c.strategy, "error", err)
+		}
+		for _, t := range times {
+			stats[t.Pid] = pidStatFromTimes(t)
+		}
+		return stats
+	}
+	for _, activeProc := range procs {
+		stat, err := c.readPidStat(activeProc.Pid)
+		if err != nil {
+			log.Debug("cannot read /proc/<pid>/stat", "error", err)
+			continue
+		}
+		stats[activeProc.Pid] = stat
+	}
+	return stats
+}
+
+// pidStatFromTimes converts times read in the kernel to the units of /proc/<pid>/stat
+func pidStatFromTimes(t ebpf.ProcTimes) proc.PidStat {
+	return proc.PidStat{
+		Pid:       t.Pid,
+		Comm:      t.Comm,
+		State:     t.State,
+		Ppid:      t.Ppid,
+		Session:   t.Session,
+		Utime:     proc.NsToTicks(t.Utime),
+		Stime:     proc.NsToTicks(t.Stime),
+		StartTime: proc.NsToTicks(t.StartTime),
+		Processor: t.Cpu,
+	}
+}
+
+func (c *collector) readPidStat(pid Pid) (proc.PidStat, error) {
+	data, err := c.src.PidStat(pid)
+	if err != nil {
+		return proc.PidStat{}, err
+	}
+	return proc.ParsePidStat(pid, string(data))
+}
+
+// readCpuStat returns the host cpu ticks used since the previous tick, and
+// the time since boot at ts
+func (c *collector) readCpuStat(ts time.Time) (proc.CpuTicks, proc.CpuTicks, error) {
+	data, err := c.src.CpuStat()
+	if err != nil {
+		return 0, 0, err
+	}
+	cpuTicks, err := proc.ParseCpuStat(0, proc.UserNiceSystem, string(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	var hostTicks proc.CpuTicks
+	if c.lastCpuTicks != 0 && cpuTicks[0] > c.lastCpuTicks {
+		hostTicks = cpuTicks[0] - c.lastCpuTicks
+	}
+	c.lastCpuTicks = cpuTicks[0]
+
+	uptime, err := uptimeAt(string(data), ts)
+	return hostTicks, uptime, err
+}
+
+// uptimeAt returns the time since boot at ts, in ticks, using the btime of
+// the /proc/stat content data
+func uptimeAt(data string, ts time.Time) (proc.CpuTicks, error) {
+	btime, err := proc.ParseBootTime(data)
+	if err != nil {
+		return 0, err
+	}
+	secs := ts.Unix() - int64(btime)
+	if secs <= 0 {
+		return 0, fmt.Errorf("tick %v before boot time %d", ts, btime)
+	}
+	return proc.CpuTicks(secs) * proc.UserHZ, nil
+}
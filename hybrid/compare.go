@@ -0,0 +1,304 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/record"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+// reasons a process is missed by hybrid
+const (
+	missShortLived = "short-lived"  // started in the interval
+	missIsolated   = "isolated-cpu" // last ran on an isolated cpu
+	missNoSwitch   = "no-switch"    // ran the interval without a context switch
+	missExited     = "exited"       // exited before hybrid caught up on its cpu time
+)
+
+// interval is the comparison result of one tick
+type interval struct {
+	ts           time.Time
+	truthProcs   int
+	hybridProcs  int
+	missedProcs  int
+	truthTicks   proc.CpuTicks
+	missedTicks  proc.CpuTicks
+	exitedProcs  int
+	exitedTicks  proc.CpuTicks
+	hybridTicks  proc.CpuTicks
+	scanDuration time.Duration
+}
+
+// offender is a process hybrid missed cpu time of
+type offender struct {
+	pid  Pid
+	comm string
+	// unit is the systemd unit with --units
+	unit      string
+	reason    string
+	ticks     proc.CpuTicks
+	intervals int
+}
+
+type offenderKey struct {
+	pid       Pid
+	startTime proc.CpuTicks
+}
+
+// comparison runs the hybrid collector and a full /proc scan on the same
+// ticks, and treats the full scan as the ground truth
+type comparison struct {
+	src          record.Source
+	isolatedCPUs []CPUId
+	hybrid       *collector
+	truth        *usage.Tracker
+	units        *systemd.Resolver
+
+	// last stat of every process, from the full scan and from hybrid
+	truthLast  map[Pid]proc.PidStat
+	hybridLast map[Pid]proc.PidStat
+
+	intervals []interval
+	offenders map[offenderKey]*offender
+}
+
+func compare(ctx context.Context, s *session, ticks int, report string, top int) error {
+	c := &comparison{
+		src:          s.src,
+		isolatedCPUs: s.isolatedCPUs,
+		hybrid:       newCollector(s.src, s.isolatedCPUs, s.strategy),
+		truth:        usage.NewTracker(),
+		units:        s.units,
+		truthLast:    map[Pid]proc.PidStat{},
+		hybridLast:   map[Pid]proc.PidStat{},
+		offenders:    map[offenderKey]*offender{},
+	}
+	err := s.loop(ctx, func(ts, startedAt time.Time) bool {
+		c.tick(ts)
+		return ticks == 0 || len(c.intervals) < ticks
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(report)
+	if err != nil {
+		return fmt.Errorf("cannot create report: %w", err)
+	}
+	defer f.Close()
+	if err := c.writeReport(f, s.interval, top); err != nil {
+		return fmt.Errorf("cannot write report: %w", err)
+	}
+	log.Info("Report written", "file", report, "intervals", len(c.intervals))
+	return nil
+}
+
+func (c *comparison) tick(ts time.Time) {
+	res := c.hybrid.collect(ts)
+	hybridTicks := map[Pid]proc.CpuTicks{}
+	for _, d := range res.deltas {
+		hybridTicks[d.Pid] = d.Ticks
+		c.hybridLast[d.Pid] = d.PidStat
+	}
+
+	// full scan of /proc
+	scanStart := time.Now()
+	pids, err := c.src.Pids()
+	if err != nil {
+		log.Error("cannot list /proc", "error", err)
+	}
+	stats := make([]proc.PidStat, 0, len(pids))
+	for _, pid := range pids {
+		data, err := c.src.PidStat(pid)
+		if err != nil {
+			continue
+		}
+		stat, err := proc.ParsePidStat(pid, string(data))
+		if err != nil {
+			log.Error("cannot parse /proc/<pid>/stat", "pid", pid, "error", err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	truthDeltas := c.truth.Update(res.uptime, stats)
+
+	iv := interval{
+		ts:           ts,
+		truthProcs:   len(truthDeltas),
+		hybridProcs:  res.procsRead,
+		hybridTicks:  usage.Sum(res.deltas),
+		scanDuration: time.Since(scanStart),
+	}
+	seen := make(map[Pid]proc.PidStat, len(truthDeltas))
+	for _, d := range truthDeltas {
+		seen[d.Pid] = d.PidStat
+		iv.truthTicks += d.Ticks
+		hy, read := hybridTicks[d.Pid]
+		if d.Ticks <= hy {
+			continue
+		}
+		if !read {
+			iv.missedProcs++
+		}
+		iv.missedTicks += d.Ticks - hy
+		c.offend(d.PidStat, c.reason(d), d.Ticks-hy)
+	}
+
+	// processes gone since the previous scan take with them whatever cpu
+	// time hybrid had not read yet
+	for pid, last := range c.truthLast {
+		if _, ok := seen[pid]; ok {
+			continue
+		}
+		c.truth.Forget(pid)
+		if c.units != nil {
+			c.units.Forget(pid)
+		}
+		lost := last.Total()
+		if hy, ok := c.hybridLast[pid]; ok && hy.StartTime == last.StartTime {
+			lost -= min(lost, hy.Total())
+		}
+		delete(c.hybridLast, pid)
+		if lost == 0 {
+			continue
+		}
+		iv.exitedProcs++
+		iv.exitedTicks += lost
+		if o, ok := c.offenders[offenderKey{pid, last.StartTime}]; ok {
+			o.reason = missExited
+		}
+	}
+	c.truthLast = seen
+	c.intervals = append(c.intervals, iv)
+
+	log.Info("Compare",
+		"truth-procs", iv.truthProcs,
+		"hybrid-procs", iv.hybridProcs,
+		"missed-procs", iv.missedProcs,
+		"truth-cpu", ticksToSeconds(iv.truthTicks),
+		"missed-cpu", ticksToSeconds(iv.missedTicks),
+		"exited-procs", iv.exitedProcs,
+		"lost-cpu", ticksToSeconds(iv.exitedTicks),
+	)
+}
+
+func (c *comparison) reason(d usage.Delta) string {
+	switch {
+	case d.New:
+		return missShortLived
+	case slices.Contains(c.isolatedCPUs, d.Processor):
+		return missIsolated
+	default:
+		return missNoSwitch
+	}
+}
+
+func (c *comparison) offend(stat proc.PidStat, reason string, ticks proc.CpuTicks) {
+	key := offenderKey{stat.Pid, stat.StartTime}
+	o, ok := c.offenders[key]
+	if !ok {
+		o = &offender{pid: stat.Pid, comm: stat.Comm, reason: reason}
+		if c.units != nil {
+			o.unit = c.units.Get(stat).String()
+		}
+		c.offenders[key] = o
+	}
+	o.ticks += ticks
+	o.intervals++
+}
+
+func (c *comparison) writeReport(w io.Writer, loopInterval time.Duration, top int) error {
+	var truthTicks, missedTicks, exitedTicks, hybridTicks proc.CpuTicks
+	var missedProcs int
+	var scan time.Duration
+	for _, iv := range c.intervals {
+		truthTicks += iv.truthTicks
+		missedTicks += iv.missedTicks
+		exitedTicks += iv.exitedTicks
+		hybridTicks += iv.hybridTicks
+		missedProcs += iv.missedProcs
+		scan += iv.scanDuration
+	}
+	n := max(len(c.intervals), 1)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "## Hybrid accuracy\n")
+	fmt.Fprintf(b, "Ground truth is a full /proc scan, taken on the same tick right after the hybrid collection. ")
+	fmt.Fprintf(b, "The strategies reading the cpu times in the kernel scale them to the runtime of the process as /proc does, so both sides count the same time.\n\n")
+	fmt.Fprintf(b, "## Steps\n")
+	fmt.Fprintf(b, "1. Run `sudo ./%s --strategy %s compare --ticks %d --report <file>`\n\n", toolName, c.hybrid.strategy, len(c.intervals))
+	fmt.Fprintf(b, "## Summary\n")
+	fmt.Fprintf(b, "| | |\n|---|---|\n")
+	fmt.Fprintf(b, "| strategy | %s |\n", c.hybrid.strategy)
+	fmt.Fprintf(b, "| intervals | %d |\n", len(c.intervals))
+	fmt.Fprintf(b, "| loop interval | %s |\n", loopInterval)
+	fmt.Fprintf(b, "| isolated cpus | %v |\n", c.isolatedCPUs)
+	fmt.Fprintf(b, "| ground truth cpu | %.2fs |\n", ticksToSeconds(truthTicks))
+	fmt.Fprintf(b, "| hybrid cpu | %.2fs |\n", ticksToSeconds(hybridTicks))
+	fmt.Fprintf(b, "| missed cpu | %.2fs (%.2f%%) |\n", ticksToSeconds(missedTicks), percent(missedTicks, truthTicks))
+	fmt.Fprintf(b, "| missed procs per interval | %.2f |\n", float64(missedProcs)/float64(n))
+	fmt.Fprintf(b, "| cpu lost with exited procs | %.2fs |\n", ticksToSeconds(exitedTicks))
+	fmt.Fprintf(b, "| full scan cost per interval | %s |\n\n", scan/time.Duration(n))
+
+	fmt.Fprintf(b, "## Intervals\n")
+	fmt.Fprintf(b, "| time | truth procs | hybrid procs | missed procs | truth cpu | missed cpu | exited procs | lost cpu |\n")
+	fmt.Fprintf(b, "|---|---|---|---|---|---|---|---|\n")
+	for _, iv := range c.intervals {
+		fmt.Fprintf(b, "| %s | %d | %d | %d | %.2fs | %.2fs | %d | %.2fs |\n",
+			iv.ts.Format("15:04:05.000"),
+			iv.truthProcs,
+			iv.hybridProcs,
+			iv.missedProcs,
+			ticksToSeconds(iv.truthTicks),
+			ticksToSeconds(iv.missedTicks),
+			iv.exitedProcs,
+			ticksToSeconds(iv.exitedTicks),
+		)
+	}
+	fmt.Fprintln(b)
+
+	offenders := make([]*offender, 0, len(c.offenders))
+	for _, o := range c.offenders {
+		offenders = append(offenders, o)
+	}
+	slices.SortFunc(offenders, func(a, b *offender) int {
+		return cmp.Or(cmp.Compare(b.ticks, a.ticks), cmp.Compare(a.pid, b.pid))
+	})
+	fmt.Fprintf(b, "## Top offenders\n")
+	if c.units != nil {
+		fmt.Fprintf(b, "| pid | comm | unit | reason | missed cpu | intervals |\n")
+		fmt.Fprintf(b, "|---|---|---|---|---|---|\n")
+	} else {
+		fmt.Fprintf(b, "| pid | comm | reason | missed cpu | intervals |\n")
+		fmt.Fprintf(b, "|---|---|---|---|---|\n")
+	}
+	for _, o := range offenders[:min(top, len(offenders))] {
+		if c.units != nil {
+			fmt.Fprintf(b, "| %d | %s | %s | %s | %.2fs | %d |\n", o.pid, o.comm, o.unit, o.reason, ticksToSeconds(o.ticks), o.intervals)
+		} else {
+			fmt.Fprintf(b, "| %d | %s | %s | %.2fs | %d |\n", o.pid, o.comm, o.reason, ticksToSeconds(o.ticks), o.intervals)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func percent(part, total proc.CpuTicks) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"golang.org/x/sys/unix"
+)
+
+// printEvents prints the process lifecycle events as they happen, until ctx
+// is done
+func printEvents(ctx context.Context, s *session) error {
+	if s.events == nil {
+		return fmt.Errorf("process events not read")
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return err
+	}
+	if s.units != nil {
+		fmt.Fprintf(os.Stdout, "%-15s %-5s %7s %7s %-16s %-24s %s\n", "TIME", "EVENT", "PID", "PPID", "COMM", "UNIT", "EXE/EXIT")
+	} else {
+		fmt.Fprintf(os.Stdout, "%-15s %-5s %7s %7s %-16s %s\n", "TIME", "EVENT", "PID", "PPID", "COMM", "EXE/EXIT")
+	}
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				return nil
+			}
+			printEvent(os.Stdout, boot, ev, s.units)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// bootTime returns the wall clock time of the boot, event times are since then
+func bootTime() (time.Time, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return time.Time{}, fmt.Errorf("cannot read the time since boot: %w", err)
+	}
+	return time.Now().Add(-time.Duration(ts.Nano())), nil
+}
+
+// printEvent prints ev, with the unit of its process when units is set: read
+// at its fork or exec, the one of its parent if it exited before
+func printEvent(w io.Writer, boot time.Time, ev ebpf.ProcEvent, units *systemd.Resolver) {
+	detail := ev.Exe
+	if ev.Type == ebpf.ProcExit {
+		detail = fmt.Sprintf("status %d signal %d", ev.ExitCode>>8&0xff, ev.ExitCode&0x7f)
+	}
+	ts := boot.Add(time.Duration(ev.Time)).Format(time.TimeOnly + ".000000")
+	if units == nil {
+		fmt.Fprintf(w, "%-15s %-5s %7d %7d %-16s %s\n", ts, ev.Type, ev.Pid, ev.Ppid, ev.Comm, detail)
+		return
+	}
+	stat := proc.PidStat{Pid: ev.Pid, Ppid: ev.Ppid, StartTime: proc.NsToTicks(ev.StartTime)}
+	var unit systemd.Unit
+	if ev.Type == ebpf.ProcExit {
+		unit = units.Exited(stat)
+	} else {
+		unit = units.Get(stat)
+	}
+	fmt.Fprintf(w, "%-15s %-5s %7d %7d %-16s %-24s %s\n", ts, ev.Type, ev.Pid, ev.Ppid, ev.Comm, unit, detail)
+}
@@ -5,12 +5,12 @@ go 1.24.1
 require (
 	github.com/alecthomas/kingpin v2.2.6+incompatible
 	github.com/cilium/ebpf v0.18.0
+	github.com/google/go-cmp v0.7.0
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sys v0.30.0
 )
 
 require (
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
 	github.com/alecthomas/units v0.0.0-20240927000941-0f3dac36c52b // indirect
-	github.com/google/go-cmp v0.7.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 )
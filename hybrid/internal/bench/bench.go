@@ -0,0 +1,230 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Sample is the cost of one collection tick
+type Sample struct {
+	Wall              time.Duration
+	CPU               time.Duration // user + system time of the whole process
+	Allocs            uint64        // heap objects allocated
+	AllocBytes        uint64        // heap bytes allocated
+	ReadWriteSyscalls uint64        // read and write syscalls from /proc/self/io, bpf() is not counted
+}
+
+type snapshot struct {
+	wall              time.Time
+	cpu               time.Duration
+	allocs            uint64
+	allocBytes        uint64
+	readWriteSyscalls uint64
+}
+
+// Meter measures the cost of the code run between Start and Stop
+type Meter struct {
+	start snapshot
+}
+
+func Start() *Meter {
+	m := &Meter{}
+	// the cheapest and least disturbing reading is taken last
+	m.start.readWriteSyscalls = readRWSyscalls()
+	m.start.allocs, m.start.allocBytes = readAllocs()
+	m.start.cpu = readCPU()
+	m.start.wall = time.Now()
+	return m
+}
+
+func (m *Meter) Stop() Sample {
+	wall := time.Now()
+	cpu := readCPU()
+	allocs, allocBytes := readAllocs()
+	readWriteSyscalls := readRWSyscalls() - syscallOverhead()
+	return Sample{
+		Wall:              wall.Sub(m.start.wall),
+		CPU:               cpu - m.start.cpu,
+		Allocs:            allocs - m.start.allocs,
+		AllocBytes:        allocBytes - m.start.allocBytes,
+		ReadWriteSyscalls: readWriteSyscalls - m.start.readWriteSyscalls,
+	}
+}
+
+func readCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func readAllocs() (uint64, uint64) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs, ms.TotalAlloc
+}
+
+// syscallOverhead is the number of read and write syscalls counted for reading /proc/self/io
+var syscallOverhead = sync.OnceValue(func() uint64 {
+	before := readRWSyscalls()
+	return readRWSyscalls() - before
+})
+
+// readRWSyscalls returns syscr + syscw of /proc/self/io
+func readRWSyscalls() uint64 {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0
+	}
+	var total uint64
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		key, val, ok := strings.Cut(string(line), ": ")
+		if !ok || (key != "syscr" && key != "syscw") {
+			continue
+		}
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// Summary holds the statistics of one metric over all ticks
+type Summary struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Median float64 `json:"median"`
+	P99    float64 `json:"p99"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+}
+
+// Summarize returns the statistics of values
+func Summarize(values []float64) Summary {
+	if len(values) == 0 {
+		return Summary{}
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	var sq float64
+	for _, v := range sorted {
+		sq += (v - mean) * (v - mean)
+	}
+	return Summary{
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Median: percentile(sorted, 50),
+		P99:    percentile(sorted, 99),
+		Mean:   mean,
+		StdDev: math.Sqrt(sq / float64(len(sorted))),
+	}
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// Result is the outcome of a bench run, comparable across hosts.
+// The JSON encoding matches the bench of allproc and ebpf-task-iter.
+type Result struct {
+	Tool     string             `json:"tool"`
+	Strategy string             `json:"strategy"`
+	Host     string             `json:"host"`
+	Kernel   string             `json:"kernel"`
+	NumCPU   int                `json:"num_cpu"`
+	Interval string             `json:"interval"`
+	Ticks    int                `json:"ticks"`
+	Procs    Summary            `json:"procs"`
+	Metrics  map[string]Summary `json:"metrics"`
+}
+
+// metric names, with their unit
+const (
+	WallUs            = "wall_us"
+	CPUUs             = "cpu_us"
+	Allocs            = "allocs"
+	AllocBytes        = "alloc_bytes"
+	ReadWriteSyscalls = "read_write_syscalls"
+)
+
+// NewResult summarizes samples. procs is the number of processes
+// collected in each tick.
+func NewResult(tool, strategy string, interval time.Duration, samples []Sample, procs []int) Result {
+	values := map[string][]float64{}
+	for _, s := range samples {
+		values[WallUs] = append(values[WallUs], float64(s.Wall.Nanoseconds())/1e3)
+		values[CPUUs] = append(values[CPUUs], float64(s.CPU.Nanoseconds())/1e3)
+		values[Allocs] = append(values[Allocs], float64(s.Allocs))
+		values[AllocBytes] = append(values[AllocBytes], float64(s.AllocBytes))
+		values[ReadWriteSyscalls] = append(values[ReadWriteSyscalls], float64(s.ReadWriteSyscalls))
+	}
+	procValues := make([]float64, len(procs))
+	for i, n := range procs {
+		procValues[i] = float64(n)
+	}
+	r := Result{
+		Tool:     tool,
+		Strategy: strategy,
+		Kernel:   kernelRelease(),
+		NumCPU:   runtime.NumCPU(),
+		Interval: interval.String(),
+		Ticks:    len(samples),
+		Procs:    Summarize(procValues),
+		Metrics:  map[string]Summary{},
+	}
+	r.Host, _ = os.Hostname()
+	for name, v := range values {
+		r.Metrics[name] = Summarize(v)
+	}
+	return r
+}
+
+func kernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Print writes a human readable table of r
+func (r Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s (%s) on %s, kernel %s, %d cpus, %d ticks every %s\n",
+		r.Tool, r.Strategy, r.Host, r.Kernel, r.NumCPU, r.Ticks, r.Interval)
+	fmt.Fprintf(w, "%-20s %12s %12s %12s %12s %12s %12s\n", "metric", "min", "max", "median", "p99", "mean", "stddev")
+	print := func(name string, s Summary) {
+		fmt.Fprintf(w, "%-20s %12.1f %12.1f %12.1f %12.1f %12.1f %12.1f\n", name, s.Min, s.Max, s.Median, s.P99, s.Mean, s.StdDev)
+	}
+	print("procs", r.Procs)
+	for _, name := range []string{WallUs, CPUUs, Allocs, AllocBytes, ReadWriteSyscalls} {
+		print(name, r.Metrics[name])
+	}
+}
+
+// WriteJSON writes r to path
+func (r Result) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
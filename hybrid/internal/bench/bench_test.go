@@ -0,0 +1,44 @@
+package bench
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func Test_Summarize(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   Summary
+	}{
+		{
+			name: "empty",
+			want: Summary{},
+		},
+		{
+			name:   "single value",
+			values: []float64{5},
+			want:   Summary{Min: 5, Max: 5, Median: 5, P99: 5, Mean: 5},
+		},
+		{
+			name:   "unsorted values",
+			values: []float64{4, 1, 3, 2, 5},
+			want:   Summary{Min: 1, Max: 5, Median: 3, P99: 5, Mean: 3, StdDev: 1.4142},
+		},
+		{
+			name:   "p99 of hundred values skips the max",
+			values: append(make([]float64, 99), 100),
+			want:   Summary{Min: 0, Max: 100, Median: 0, P99: 0, Mean: 1, StdDev: 9.9499},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Summarize(tt.values)
+			if !cmp.Equal(got, tt.want, cmpopts.EquateApprox(0, 1e-4)) {
+				t.Errorf("Summarize() got: %v, want: %v, diff: %v", got, tt.want, cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
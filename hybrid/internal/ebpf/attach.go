@@ -0,0 +1,146 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// AttachType is how the sched_switch program is attached
+type AttachType string
+
+const (
+	AttachTpBtf         AttachType = "tp_btf"
+	AttachRawTracepoint AttachType = "raw_tracepoint"
+	AttachTracepoint    AttachType = "tracepoint"
+)
+
+// schedSwitch is the attached variant of the sched_switch program
+type schedSwitch struct {
+	prog   *ebpf.Program
+	link   link.Link
+	attach AttachType
+	// reused tells if the link was pinned by a previous run
+	reused bool
+}
+
+func (s *schedSwitch) Close() {
+	s.link.Close()
+	s.prog.Close()
+}
+
+// schedSwitchPrograms are the variants of the sched_switch program, in the
+// order they are tried
+var schedSwitchPrograms = []struct {
+	attach  AttachType
+	program string
+}{
+	{AttachTpBtf, "handle_sched_switch"},
+	{AttachRawTracepoint, "handle_sched_switch_raw"},
+	{AttachTracepoint, "handle_sched_switch_tp"},
+}
+
+/*
+attachSchedSwitch loads and attaches the first variant of the sched_switch
+program the kernel supports, tp_btf needs kernel BTF, raw_tracepoint Linux
+4.17, and tracepoint works everywhere. It returns the errors of every
+variant if none could be attached. With a pin directory, the link pinned
+there is reused if its program matches the variant, otherwise the new link
+is pinned in its place.
+*/
+func attachSchedSwitch(spec *ebpf.CollectionSpec, maps *keplerMaps, pinDir string) (*schedSwitch, error) {
+	pinned, err := loadPinnedSchedSwitch(pinDir)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, variant := range schedSwitchPrograms {
+		prog, err := loadProgram(spec, variant.program, maps)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", variant.attach, err))
+			continue
+		}
+		if pinned != nil && pinned.matches(prog, variant.attach) {
+			prog.Close()
+			pinned.reused = true
+			return pinned, nil
+		}
+		l, err := attachProgram(prog, variant.attach)
+		if err != nil {
+			prog.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", variant.attach, err))
+			continue
+		}
+		if pinDir != "" {
+			if err := pinSchedSwitch(l, pinDir); err != nil {
+				l.Close()
+				prog.Close()
+				errs = append(errs, fmt.Errorf("%s: %w", variant.attach, err))
+				continue
+			}
+		}
+		if pinned != nil {
+			// unpinned by pinSchedSwitch, detached once closed
+			pinned.Close()
+		}
+		return &schedSwitch{prog: prog, link: l, attach: variant.attach}, nil
+	}
+	if pinned != nil {
+		pinned.Close()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// loadProgram loads the program name of spec, updating the already loaded
+// maps, only its global variables are new
+func loadProgram(spec *ebpf.CollectionSpec, name string, maps *keplerMaps) (*ebpf.Program, error) {
+	spec = spec.Copy()
+	spec.Programs = map[string]*ebpf.ProgramSpec{name: spec.Programs[name]}
+	replacements := mapReplacements(maps)
+	// the maps which were not loaded are not created for this program
+	for mapName := range spec.Maps {
+		if _, ok := replacements[mapName]; !ok && !strings.HasPrefix(mapName, ".") {
+			delete(spec.Maps, mapName)
+		}
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		MapReplacements: replacements,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	return coll.DetachProgram(name), nil
+}
+
+// mapReplacements returns the loaded maps of maps by name
+func mapReplacements(maps *keplerMaps) map[string]*ebpf.Map {
+	replacements := map[string]*ebpf.Map{}
+	v := reflect.ValueOf(maps).Elem()
+	for i := range v.NumField() {
+		if m, ok := v.Field(i).Interface().(*ebpf.Map); ok && m != nil {
+			replacements[v.Type().Field(i).Tag.Get("ebpf")] = m
+		}
+	}
+	return replacements
+}
+
+func attachProgram(prog *ebpf.Program, attach AttachType) (link.Link, error) {
+	switch attach {
+	case AttachTpBtf:
+		return link.AttachTracing(link.TracingOptions{
+			Program:    prog,
+			AttachType: ebpf.AttachTraceRawTp,
+		})
+	case AttachRawTracepoint:
+		return link.AttachRawTracepoint(link.RawTracepointOptions{
+			Name:    "sched_switch",
+			Program: prog,
+		})
+	}
+	return link.Tracepoint("sched", "sched_switch", prog, nil)
+}
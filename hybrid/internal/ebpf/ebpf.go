@@ -2,8 +2,13 @@ package ebpf
 
 import "C"
 import (
+	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
+	"math/bits"
+	"os"
+	"slices"
 	"sync"
 	"unsafe"
 
@@ -13,16 +18,100 @@ import (
 )
 
 type ActiveProc struct {
-	Pid  Pid
+	Pid Pid
+	// Cpu is the first of Cpus
 	Cpu  CPUId
 	Comm string
+	// Cpus the process was switched out on in the interval, in order
+	Cpus []CPUId
+	// VoluntarySwitches and InvoluntarySwitches count the switches out of
+	// its threads in the interval, as voluntary_ctxt_switches and
+	// nonvoluntary_ctxt_switches of /proc/<pid>/status
+	VoluntarySwitches   uint64
+	InvoluntarySwitches uint64
+	// OffCPU is set with Options.OffCPU
+	OffCPU OffCPU
+}
+
+// AllCpus returns Cpus, or Cpu for a recording made before Cpus existed
+func (p ActiveProc) AllCpus() []CPUId {
+	if p.Cpus == nil {
+		return []CPUId{p.Cpu}
+	}
+	return p.Cpus
 }
 
 type ActiveProcs []ActiveProc
 
 type bpfManager struct {
-	bpfObjs    keplerObjects
-	tracePoint link.Link
+	spec *ebpf.CollectionSpec
+	// bpfObjs holds the maps, bpfObjs.DumpActiveTasks and its map are
+	// loaded by LoadTaskIter, bpfObjs.LookupTasks and its maps by
+	// LoadLookupTasks
+	bpfObjs     keplerObjects
+	schedSwitch *schedSwitch
+	taskIter    *link.Iter
+	// runq is set when run queue latency is measured
+	runq *runqLatency
+	// procEvents is set when the process lifecycle events are read
+	procEvents *procEvents
+	// iterBuf is reused across reads of taskIter
+	iterBuf bytes.Buffer
+	// pinLock holds the lock of the pin directory, with Options.Pin
+	pinLock *os.File
+}
+
+// ActiveProcsMap is a map type active_procs can be loaded as
+type ActiveProcsMap string
+
+const (
+	// ActiveProcsHash is shared by all cpus, and holds the first cpu a
+	// process was seen on
+	ActiveProcsHash ActiveProcsMap = "hash"
+	// ActiveProcsPerCPUHash has a value per cpu, so the cpus do not update
+	// the same value, and holds every cpu a process was seen on
+	ActiveProcsPerCPUHash ActiveProcsMap = "percpu-hash"
+	// ActiveProcsLRUPerCPUHash is ActiveProcsPerCPUHash evicting the least
+	// recently seen processes when full, instead of missing the new ones
+	ActiveProcsLRUPerCPUHash ActiveProcsMap = "lru-percpu-hash"
+)
+
+var activeProcsMapTypes = map[ActiveProcsMap]ebpf.MapType{
+	ActiveProcsHash:          ebpf.Hash,
+	ActiveProcsPerCPUHash:    ebpf.PerCPUHash,
+	ActiveProcsLRUPerCPUHash: ebpf.LRUCPUHash,
+}
+
+// Options configure the bpf instance
+type Options struct {
+	/*
+		Pin is the name of a directory under /sys/fs/bpf to pin active_procs
+		and the sched_switch link to, so they outlive the process and
+		survive a restart, nothing is pinned if empty. Pinned objects are
+		reused on startup when they match the objects of this build,
+		otherwise they are replaced. The directory is locked while in use,
+		Instance fails if another process holds it.
+	*/
+	Pin string
+	// ActiveProcsMap is the map type of active_procs, ActiveProcsHash if empty
+	ActiveProcsMap ActiveProcsMap
+	/*
+		RunqLatency attaches sched_wakeup and sched_wakeup_new to measure the
+		time tasks wait on a run queue, read by DrainRunqLatency. It needs
+		sched_switch attached as tp_btf. The sched_wakeup links are not
+		pinned.
+	*/
+	RunqLatency bool
+	// RunqLatencyPerProcess also keeps a histogram per process, it implies
+	// RunqLatency
+	RunqLatencyPerProcess bool
+	// OffCPU measures the time processes spend off cpu, in
+	// ActiveProc.OffCPU. It needs sched_switch attached as tp_btf.
+	OffCPU bool
+	// ProcEvents attaches sched_process_fork, sched_process_exec and
+	// sched_process_exit, whose events are read from Events. It needs
+	// kernel BTF and tp_btf.
+	ProcEvents bool
 }
 
 var (
@@ -31,34 +120,105 @@ var (
 	initErr  error
 )
 
-func Instance() (*bpfManager, error) {
+/*
+Instance loads the maps and attaches the sched_switch program, and the
+sched_wakeup programs with Options.RunqLatency and the lifecycle programs
+with Options.ProcEvents, on the first call, opts of the later calls are
+ignored.
+*/
+func Instance(opts Options) (*bpfManager, error) {
 	once.Do(func() {
 		instance, initErr = nil, nil
+		spec, err := loadKepler()
+		if err != nil {
+			initErr = fmt.Errorf("Failed to load BPF spec: %v", err)
+			return
+		}
+		mapType, ok := activeProcsMapTypes[cmp.Or(opts.ActiveProcsMap, ActiveProcsHash)]
+		if !ok {
+			initErr = fmt.Errorf("unknown active_procs map type %q", opts.ActiveProcsMap)
+			return
+		}
+		// set before the map is loaded, so a pinned map of another type is replaced
+		spec.Maps["active_procs"].Type = mapType
+		if err := setRunqLatency(spec, opts); err != nil {
+			initErr = fmt.Errorf("Failed to set run queue latency: %v", err)
+			return
+		}
+		if err := setOffCPU(spec, opts); err != nil {
+			initErr = fmt.Errorf("Failed to set off-CPU time: %v", err)
+			return
+		}
+		pinLock, err := lockPinDir(opts.pinDir())
+		if err != nil {
+			initErr = fmt.Errorf("Failed to lock pin directory: %v", err)
+			return
+		}
+		defer func() {
+			if initErr != nil && pinLock != nil {
+				pinLock.Close()
+			}
+		}()
+		skipped := slices.Clone(strategyMaps)
+		if !opts.ProcEvents {
+			skipped = append(skipped, procEventsMaps...)
+		}
 		bpfObjs := keplerObjects{}
-		if err := loadKeplerObjects(&bpfObjs, nil); err != nil {
-			initErr = fmt.Errorf("Failed to load BPF objects: %v", err)
+		if err := loadMaps(spec, &bpfObjs.keplerMaps, skipped, opts.pinDir()); err != nil {
+			initErr = fmt.Errorf("Failed to load BPF maps: %v", err)
 			return
 		}
 
-		// Attach the eBPF program to BTF-enabled tracepoint
-		tp, err := link.AttachTracing(link.TracingOptions{
-			Program:    bpfObjs.HandleSchedSwitch,
-			AttachType: ebpf.AttachTraceRawTp,
-		})
+		// Attach the first variant of the sched_switch program the kernel supports
+		sw, err := attachSchedSwitch(spec, &bpfObjs.keplerMaps, opts.pinDir())
 		if err != nil {
-			initErr = fmt.Errorf("Failed to attach BTF tracepoint: %v", err)
+			bpfObjs.Close()
+			initErr = fmt.Errorf("Failed to attach sched_switch: %v", err)
+			return
+		}
+		if err := checkOffCPU(opts, sw.attach); err != nil {
+			sw.Close()
+			bpfObjs.Close()
+			initErr = fmt.Errorf("Failed to measure off-CPU time: %v", err)
 			return
 		}
+		var runq *runqLatency
+		if opts.RunqLatency || opts.RunqLatencyPerProcess {
+			runq, err = attachRunqLatency(spec, &bpfObjs.keplerMaps, sw.attach)
+			if err != nil {
+				sw.Close()
+				bpfObjs.Close()
+				initErr = fmt.Errorf("Failed to attach sched_wakeup: %v", err)
+				return
+			}
+		}
+		var events *procEvents
+		if opts.ProcEvents {
+			events, err = attachProcEvents(spec, &bpfObjs.keplerMaps)
+			if err != nil {
+				if runq != nil {
+					runq.Close()
+				}
+				sw.Close()
+				bpfObjs.Close()
+				initErr = fmt.Errorf("Failed to attach process events: %v", err)
+				return
+			}
+		}
 		instance = &bpfManager{
-			bpfObjs:    bpfObjs,
-			tracePoint: tp,
+			spec:        spec,
+			bpfObjs:     bpfObjs,
+			schedSwitch: sw,
+			runq:        runq,
+			procEvents:  events,
+			pinLock:     pinLock,
 		}
 	})
 	return instance, initErr
 }
 
-func MustInstance() *bpfManager {
-	mgr, err := Instance()
+func MustInstance(opts Options) *bpfManager {
+	mgr, err := Instance(opts)
 	if err != nil {
 		panic("failed to initialize bpf " + err.Error())
 	}
@@ -67,6 +227,9 @@ func MustInstance() *bpfManager {
 
 func (bm *bpfManager) GetActiveProcs() (ActiveProcs, error) {
 	activeProcsMap := bm.bpfObjs.ActiveProcs
+	if activeProcsMap.Type() != ebpf.Hash {
+		return bm.getPerCPUActiveProcs()
+	}
 	maxEntries := activeProcsMap.MaxEntries()
 	total := 0
 	keys := make([]uint32, maxEntries)
@@ -91,14 +254,120 @@ func (bm *bpfManager) GetActiveProcs() (ActiveProcs, error) {
 	for i, proc := range values[:total] {
 		procs[i].Pid = proc.Pid
 		procs[i].Cpu = proc.Cpu
-		procs[i].Comm = C.GoString((*C.char)(unsafe.Pointer(&proc.Comm)))
+		procs[i].Comm = commString(proc.Comm)
+		procs[i].Cpus = cpusFromMask(proc.Cpus, proc.Cpu)
+		procs[i].VoluntarySwitches = proc.Nvcsw
+		procs[i].InvoluntarySwitches = proc.Nivcsw
+		procs[i].OffCPU = offCPUFrom(proc.OffCpu)
+	}
+	return procs, nil
+}
+
+// perCPUBatch is the number of keys drained at once from a per-cpu
+// active_procs, whose values take a slot per possible cpu
+const perCPUBatch = 256
+
+// getPerCPUActiveProcs drains a per-cpu active_procs, merging the values of
+// every cpu of a process
+func (bm *bpfManager) getPerCPUActiveProcs() (ActiveProcs, error) {
+	activeProcsMap := bm.bpfObjs.ActiveProcs
+	numCPU, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]uint32, perCPUBatch)
+	values := make([]keplerActiveProc, perCPUBatch*numCPU)
+	var procs ActiveProcs
+	var cursor ebpf.MapBatchCursor
+	for {
+		count, err := activeProcsMap.BatchLookupAndDelete(&cursor, keys, values, nil)
+		for i := range count {
+			procs = append(procs, mergePerCPU(values[i*numCPU:(i+1)*numCPU]))
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 	return procs, nil
 }
 
+// mergePerCPU returns the process of the values of a key of a per-cpu
+// active_procs, in cpu order, the cpus it was not seen on have a zero value
+func mergePerCPU(values []keplerActiveProc) ActiveProc {
+	var proc ActiveProc
+	var mask [len(keplerActiveProc{}.Cpus)]uint64
+	seen := false
+	for _, v := range values {
+		if v.Pid == 0 {
+			continue
+		}
+		if !seen {
+			seen = true
+			proc.Pid = v.Pid
+			proc.Cpu = v.Cpu
+			proc.Comm = commString(v.Comm)
+		}
+		for i := range mask {
+			mask[i] |= v.Cpus[i]
+		}
+		proc.VoluntarySwitches += v.Nvcsw
+		proc.InvoluntarySwitches += v.Nivcsw
+		proc.OffCPU.Add(offCPUFrom(v.OffCpu))
+	}
+	if seen {
+		proc.Cpus = cpusFromMask(mask, proc.Cpu)
+	}
+	return proc
+}
+
+// cpusFromMask returns the cpus of the active_proc.cpus bitmask, and first
+// if it is above the cpus of the mask
+func cpusFromMask(mask [len(keplerActiveProc{}.Cpus)]uint64, first CPUId) []CPUId {
+	var cpus []CPUId
+	for i, word := range mask {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			cpus = append(cpus, CPUId(i*64+bit))
+			word &^= 1 << bit
+		}
+	}
+	if int(first) >= len(mask)*64 {
+		cpus = append(cpus, first)
+	}
+	return cpus
+}
+
+func commString(comm [16]int8) string {
+	return C.GoString((*C.char)(unsafe.Pointer(&comm)))
+}
+
+// AttachType returns how the sched_switch program is attached
+func (bm *bpfManager) AttachType() AttachType {
+	return bm.schedSwitch.attach
+}
+
+// PinReused tells if the sched_switch link pinned by a previous run is used
+func (bm *bpfManager) PinReused() bool {
+	return bm.schedSwitch.reused
+}
+
 func (bm *bpfManager) Close() {
+	if bm.taskIter != nil {
+		bm.taskIter.Close()
+	}
+	if bm.runq != nil {
+		bm.runq.Close()
+	}
+	if bm.procEvents != nil {
+		bm.procEvents.Close()
+	}
+	// a pinned link stays attached
+	bm.schedSwitch.Close()
 	bm.bpfObjs.Close()
-	if bm.tracePoint != nil {
-		bm.tracePoint.Close()
+	if bm.pinLock != nil {
+		bm.pinLock.Close()
 	}
 }
@@ -0,0 +1,135 @@
+package ebpf
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+func comm(s string) [16]int8 {
+	var c [16]int8
+	for i := range len(s) {
+		c[i] = int8(s[i])
+	}
+	return c
+}
+
+func Test_mergePerCPU(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []keplerActiveProc
+		want   ActiveProc
+	}{
+		{
+			name: "one cpu",
+			values: []keplerActiveProc{
+				{},
+				{Pid: 10, Cpu: 1, Comm: comm("a"), Cpus: [8]uint64{1 << 1}},
+				{},
+			},
+			want: ActiveProc{Pid: 10, Cpu: 1, Comm: "a", Cpus: []CPUId{1}},
+		},
+		{
+			name: "first cpu and comm win",
+			values: []keplerActiveProc{
+				{Pid: 10, Cpu: 0, Comm: comm("a"), Cpus: [8]uint64{1 << 0}, Nvcsw: 1},
+				{},
+				{Pid: 10, Cpu: 2, Comm: comm("b"), Cpus: [8]uint64{1 << 2}, Nvcsw: 2, Nivcsw: 1, OffCpu: [3]uint64{10, 20, 30}},
+				{Pid: 10, Cpu: 3, Comm: comm("b"), Cpus: [8]uint64{1 << 3}, Nivcsw: 3, OffCpu: [3]uint64{1, 0, 5}},
+			},
+			want: ActiveProc{
+				Pid: 10, Cpu: 0, Comm: "a", Cpus: []CPUId{0, 2, 3},
+				VoluntarySwitches: 3, InvoluntarySwitches: 4,
+				OffCPU: OffCPU{Sleeping: 11, Uninterruptible: 20, Preempted: 35},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergePerCPU(tt.values)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mergePerCPU() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func Test_cpusFromMask(t *testing.T) {
+	tests := []struct {
+		name  string
+		mask  [8]uint64
+		first CPUId
+		want  []CPUId
+	}{
+		{
+			name:  "one cpu",
+			mask:  [8]uint64{1 << 5},
+			first: 5,
+			want:  []CPUId{5},
+		},
+		{
+			name:  "several words",
+			mask:  [8]uint64{1<<0 | 1<<63, 0, 1 << 1, 0, 0, 0, 0, 1 << 63},
+			first: 63,
+			want:  []CPUId{0, 63, 129, 511},
+		},
+		{
+			name:  "first above the mask",
+			mask:  [8]uint64{1 << 2},
+			first: 600,
+			want:  []CPUId{2, 600},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cpusFromMask(tt.mask, tt.first)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("cpusFromMask() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func Test_scaleTimes(t *testing.T) {
+	tests := []struct {
+		name                string
+		utime, stime, rtime uint64
+		wantUtime           uint64
+		wantStime           uint64
+	}{
+		{
+			name:  "ratio kept",
+			utime: 3e9, stime: 1e9, rtime: 2e9,
+			wantUtime: 1.5e9, wantStime: 0.5e9,
+		},
+		{
+			name:  "no system time",
+			utime: 4e6, stime: 0, rtime: 3_500_000,
+			wantUtime: 3_500_000, wantStime: 0,
+		},
+		{
+			name:  "no user time",
+			utime: 0, stime: 4e6, rtime: 3_500_000,
+			wantUtime: 0, wantStime: 3_500_000,
+		},
+		{
+			name:  "ran between ticks",
+			utime: 0, stime: 0, rtime: 700_000,
+			wantUtime: 700_000, wantStime: 0,
+		},
+		{
+			name:  "product beyond 64 bits",
+			utime: 1 << 40, stime: 1 << 40, rtime: 1 << 41,
+			wantUtime: 1 << 40, wantStime: 1 << 40,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utime, stime := scaleTimes(tt.utime, tt.stime, tt.rtime)
+			if utime != tt.wantUtime || stime != tt.wantStime {
+				t.Errorf("scaleTimes() = %v, %v, want %v, %v", utime, stime, tt.wantUtime, tt.wantStime)
+			}
+		})
+	}
+}
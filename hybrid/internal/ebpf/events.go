@@ -0,0 +1,181 @@
+package ebpf
+
+import "C"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// ProcEventType is what happened to a process, as enum lifecycle_type
+type ProcEventType uint32
+
+const (
+	ProcFork ProcEventType = 1 + iota
+	ProcExec
+	ProcExit
+)
+
+func (t ProcEventType) String() string {
+	switch t {
+	case ProcFork:
+		return "fork"
+	case ProcExec:
+		return "exec"
+	case ProcExit:
+		return "exit"
+	}
+	return fmt.Sprintf("ProcEventType(%d)", uint32(t))
+}
+
+// ProcEvent is a fork, exec or exit of a process, the threads are not reported
+type ProcEvent struct {
+	Type ProcEventType
+	Pid  Pid
+	Ppid Pid
+	// Session is the session id
+	Session Pid
+	// Comm is the one after an exec
+	Comm string
+	// Exe is the file of an exec, as passed to execve
+	Exe string
+	// StartTime is when the process started, in ns since boot, as ProcTimes.StartTime
+	StartTime uint64
+	// Time is when the event happened, in ns since boot
+	Time uint64
+	// ExitCode is the wait status of an exit
+	ExitCode uint32
+	// Runtime is the cpu time of the whole process at an exit, in ns, which
+	// utime and stime of /proc/<pid>/stat add up to
+	Runtime uint64
+}
+
+const lifecycleEventSize = int(unsafe.Sizeof(keplerLifecycleEvent{}))
+
+// eventsBuffer is the number of events the channel of Events holds before
+// the reader waits, the ring buffer then fills up and drops events
+const eventsBuffer = 1024
+
+// procEvents holds the lifecycle links and the reader of their ring buffer
+type procEvents struct {
+	links  []link.Link
+	reader *ringbuf.Reader
+	events chan ProcEvent
+	// stop unblocks read waiting for the channel, done is closed when it returns
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (p *procEvents) Close() {
+	for _, l := range p.links {
+		l.Close()
+	}
+	if p.reader != nil {
+		close(p.stop)
+		p.reader.Close()
+		<-p.done
+	}
+}
+
+// lifecyclePrograms are the programs writing to proc_events
+var lifecyclePrograms = []string{"handle_sched_process_fork", "handle_sched_process_exec", "handle_sched_process_exit"}
+
+// procEventsMaps are the maps which are only loaded with Options.ProcEvents,
+// the ring buffer needs Linux 5.8
+var procEventsMaps = []string{"proc_events"}
+
+/*
+attachProcEvents loads and attaches the lifecycle programs, and starts
+reading their events. They need kernel BTF and tp_btf, as they read the
+task_struct of the process.
+*/
+func attachProcEvents(spec *ebpf.CollectionSpec, maps *keplerMaps) (*procEvents, error) {
+	p := &procEvents{}
+	for _, name := range lifecyclePrograms {
+		prog, err := loadProgram(spec, name, maps)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		l, err := link.AttachTracing(link.TracingOptions{
+			Program:    prog,
+			AttachType: ebpf.AttachTraceRawTp,
+		})
+		// the link holds the program
+		prog.Close()
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		p.links = append(p.links, l)
+	}
+	reader, err := ringbuf.NewReader(maps.ProcEvents)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("cannot read proc_events: %w", err)
+	}
+	p.reader = reader
+	p.events = make(chan ProcEvent, eventsBuffer)
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.read()
+	return p, nil
+}
+
+// read sends the events of the ring buffer to the channel, until the reader is closed
+func (p *procEvents) read() {
+	defer close(p.done)
+	defer close(p.events)
+	var record ringbuf.Record
+	for {
+		if err := p.reader.ReadInto(&record); err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if len(record.RawSample) < lifecycleEventSize {
+			continue
+		}
+		ev := (*keplerLifecycleEvent)(unsafe.Pointer(&record.RawSample[0]))
+		select {
+		case p.events <- procEventFrom(ev):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func procEventFrom(ev *keplerLifecycleEvent) ProcEvent {
+	return ProcEvent{
+		Type:      ProcEventType(ev.Type),
+		Pid:       ev.Pid,
+		Ppid:      ev.Ppid,
+		Session:   ev.Sid,
+		Comm:      commString(ev.Comm),
+		Exe:       C.GoString((*C.char)(unsafe.Pointer(&ev.Filename))),
+		StartTime: ev.StartTime,
+		Time:      ev.Ts,
+		ExitCode:  ev.ExitCode,
+		Runtime:   ev.Runtime,
+	}
+}
+
+/*
+Events returns the forks, execs and exits of processes, in the order the
+kernel recorded them, with Options.ProcEvents, nil otherwise. The channel is
+closed by Close. Events are dropped by the kernel if the channel is not read
+fast enough.
+*/
+func (bm *bpfManager) Events() <-chan ProcEvent {
+	if bm.procEvents == nil {
+		return nil
+	}
+	return bm.procEvents.events
+}
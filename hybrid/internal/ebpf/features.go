@@ -0,0 +1,159 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+)
+
+// Feature is a kernel capability the collection strategies depend on
+type Feature string
+
+const (
+	FeatureBTF         Feature = "btf"
+	FeatureTpBtf       Feature = "tp_btf"
+	FeatureTaskIter    Feature = "task-iter"
+	FeatureRingBuf     Feature = "ringbuf"
+	FeatureBatchOps    Feature = "batch-map-ops"
+	FeatureTaskFromPid Feature = "bpf_task_from_pid"
+)
+
+// AllFeatures lists the probed features, in report order
+var AllFeatures = []Feature{
+	FeatureBTF,
+	FeatureTpBtf,
+	FeatureTaskIter,
+	FeatureRingBuf,
+	FeatureBatchOps,
+	FeatureTaskFromPid,
+}
+
+// Features maps every feature to nil if the kernel has it, otherwise to the
+// reason it is missing
+type Features map[Feature]error
+
+// Missing returns the reasons any of needed is missing, nil if all are there
+func (f Features) Missing(needed ...Feature) error {
+	var reasons []string
+	for _, feature := range needed {
+		err, probed := f[feature]
+		if !probed {
+			err = errors.New("not probed")
+		}
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", feature, err))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(reasons, "; "))
+}
+
+// Probe checks which features the running kernel has
+func Probe() Features {
+	f := Features{}
+	spec, err := btf.LoadKernelSpec()
+	f[FeatureBTF] = err
+	if err != nil {
+		err = fmt.Errorf("needs kernel BTF: %w", err)
+		f[FeatureTpBtf], f[FeatureTaskIter], f[FeatureTaskFromPid] = err, err, err
+	} else {
+		f[FeatureTpBtf] = haveTpBtf()
+		f[FeatureTaskIter] = haveTaskIter()
+		f[FeatureTaskFromPid] = firstErr(
+			features.HaveProgramType(ebpf.Syscall),
+			haveKernelType(spec, "bpf_task_from_pid", &btf.Func{}),
+			// lookup_tasks walks the threads with an open-coded iterator
+			haveKernelType(spec, "bpf_iter_task_new", &btf.Func{}),
+		)
+	}
+	f[FeatureRingBuf] = features.HaveMapType(ebpf.RingBuf)
+	f[FeatureBatchOps] = haveBatchOps()
+	return f
+}
+
+/*
+haveTpBtf loads an empty tp_btf program for sched_switch, the tracepoint
+handle_sched_switch attaches to. features.HaveProgramType(ebpf.Tracing) is
+not used, it probes with an fentry program, which some kernels refuse
+where tp_btf programs load.
+*/
+func haveTpBtf() error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       ebpf.Tracing,
+		AttachType: ebpf.AttachTraceRawTp,
+		AttachTo:   "sched_switch",
+		License:    "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot load tp_btf program: %w", err)
+	}
+	return prog.Close()
+}
+
+// haveTaskIter loads an empty task iterator program, as dump_active_tasks is
+func haveTaskIter() error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       ebpf.Tracing,
+		AttachType: ebpf.AttachTraceIter,
+		AttachTo:   "task",
+		License:    "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot load task iterator program: %w", err)
+	}
+	return prog.Close()
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func haveKernelType[T btf.Type](spec *btf.Spec, name string, typ T) error {
+	if err := spec.TypeByName(name, &typ); err != nil {
+		return fmt.Errorf("kernel has no %s: %w", name, ebpf.ErrNotSupported)
+	}
+	return nil
+}
+
+// haveBatchOps checks for BPF_MAP_LOOKUP_AND_DELETE_BATCH on hash maps, which
+// GetActiveProcs drains active_procs with
+func haveBatchOps() error {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create map: %w", err)
+	}
+	defer m.Close()
+	keys := make([]uint32, 1)
+	values := make([]uint32, 1)
+	var cursor ebpf.MapBatchCursor
+	_, err = m.BatchLookupAndDelete(&cursor, keys, values, nil)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	return err
+}
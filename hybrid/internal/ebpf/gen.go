@@ -1,3 +1,4 @@
 package ebpf
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -go-package ebpf kepler sched.bpf.c
+//go:generate sh -c "test -f vmlinux.h || bpftool btf dump file ${VMLINUX_BTF:-/sys/kernel/btf/vmlinux} format c > vmlinux.h"
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -go-package ebpf -type task_times -type task_lookup_args -type runq_tgid_hist -type lifecycle_event kepler sched.bpf.c
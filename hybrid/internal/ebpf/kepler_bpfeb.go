@@ -13,9 +13,59 @@ import (
 )
 
 type keplerActiveProc struct {
-	Pid  uint32
-	Cpu  int32
-	Comm [16]int8
+	Pid    uint32
+	Cpu    int32
+	Comm   [16]int8
+	Cpus   [8]uint64
+	Nvcsw  uint64
+	Nivcsw uint64
+	OffCpu [3]uint64
+}
+
+type keplerLifecycleEvent struct {
+	Type      uint32
+	Pid       uint32
+	Ppid      uint32
+	Sid       uint32
+	ExitCode  uint32
+	_         [4]byte
+	StartTime uint64
+	Ts        uint64
+	Runtime   uint64
+	Comm      [16]int8
+	Filename  [128]int8
+}
+
+type keplerOffCpuStart struct {
+	Ts    uint64
+	State uint32
+	_     [4]byte
+}
+
+type keplerRunqHist struct{ Slots [32]uint64 }
+
+type keplerRunqTgidHist struct {
+	Comm  [16]int8
+	Slots [32]uint64
+}
+
+type keplerTaskLookupArgs struct {
+	NrPids  uint32
+	NrFound uint32
+}
+
+type keplerTaskTimes struct {
+	Tgid      uint32
+	Pid       uint32
+	Utime     uint64
+	Stime     uint64
+	Runtime   uint64
+	StartTime uint64
+	Ppid      uint32
+	State     uint32
+	Cpu       int32
+	Sid       uint32
+	Comm      [16]int8
 }
 
 // loadKepler returns the embedded CollectionSpec for kepler.
@@ -60,20 +110,43 @@ type keplerSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type keplerProgramSpecs struct {
-	HandleSchedSwitch *ebpf.ProgramSpec `ebpf:"handle_sched_switch"`
+	DumpActiveTasks        *ebpf.ProgramSpec `ebpf:"dump_active_tasks"`
+	HandleSchedProcessExec *ebpf.ProgramSpec `ebpf:"handle_sched_process_exec"`
+	HandleSchedProcessExit *ebpf.ProgramSpec `ebpf:"handle_sched_process_exit"`
+	HandleSchedProcessFork *ebpf.ProgramSpec `ebpf:"handle_sched_process_fork"`
+	HandleSchedSwitch      *ebpf.ProgramSpec `ebpf:"handle_sched_switch"`
+	HandleSchedSwitchRaw   *ebpf.ProgramSpec `ebpf:"handle_sched_switch_raw"`
+	HandleSchedSwitchTp    *ebpf.ProgramSpec `ebpf:"handle_sched_switch_tp"`
+	HandleSchedWakeup      *ebpf.ProgramSpec `ebpf:"handle_sched_wakeup"`
+	HandleSchedWakeupNew   *ebpf.ProgramSpec `ebpf:"handle_sched_wakeup_new"`
+	LookupTasks            *ebpf.ProgramSpec `ebpf:"lookup_tasks"`
 }
 
 // keplerMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type keplerMapSpecs struct {
-	ActiveProcs *ebpf.MapSpec `ebpf:"active_procs"`
+	ActiveProcs   *ebpf.MapSpec `ebpf:"active_procs"`
+	FailedInserts *ebpf.MapSpec `ebpf:"failed_inserts"`
+	IterTgids     *ebpf.MapSpec `ebpf:"iter_tgids"`
+	LookupPids    *ebpf.MapSpec `ebpf:"lookup_pids"`
+	LookupTimes   *ebpf.MapSpec `ebpf:"lookup_times"`
+	OffCpuSince   *ebpf.MapSpec `ebpf:"off_cpu_since"`
+	ProcEvents    *ebpf.MapSpec `ebpf:"proc_events"`
+	RunqEnqueued  *ebpf.MapSpec `ebpf:"runq_enqueued"`
+	RunqHistCpu   *ebpf.MapSpec `ebpf:"runq_hist_cpu"`
+	RunqHistTgid  *ebpf.MapSpec `ebpf:"runq_hist_tgid"`
 }
 
 // keplerVariableSpecs contains global variables before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type keplerVariableSpecs struct {
+	OffCpu               *ebpf.VariableSpec `ebpf:"off_cpu"`
+	RunqLatency          *ebpf.VariableSpec `ebpf:"runq_latency"`
+	RunqLatencyPerTgid   *ebpf.VariableSpec `ebpf:"runq_latency_per_tgid"`
+	UnusedLifecycleEvent *ebpf.VariableSpec `ebpf:"unused_lifecycle_event"`
+	UnusedTaskTimes      *ebpf.VariableSpec `ebpf:"unused_task_times"`
 }
 
 // keplerObjects contains all objects after they have been loaded into the kernel.
@@ -96,12 +169,30 @@ func (o *keplerObjects) Close() error {
 //
 // It can be passed to loadKeplerObjects or ebpf.CollectionSpec.LoadAndAssign.
 type keplerMaps struct {
-	ActiveProcs *ebpf.Map `ebpf:"active_procs"`
+	ActiveProcs   *ebpf.Map `ebpf:"active_procs"`
+	FailedInserts *ebpf.Map `ebpf:"failed_inserts"`
+	IterTgids     *ebpf.Map `ebpf:"iter_tgids"`
+	LookupPids    *ebpf.Map `ebpf:"lookup_pids"`
+	LookupTimes   *ebpf.Map `ebpf:"lookup_times"`
+	OffCpuSince   *ebpf.Map `ebpf:"off_cpu_since"`
+	ProcEvents    *ebpf.Map `ebpf:"proc_events"`
+	RunqEnqueued  *ebpf.Map `ebpf:"runq_enqueued"`
+	RunqHistCpu   *ebpf.Map `ebpf:"runq_hist_cpu"`
+	RunqHistTgid  *ebpf.Map `ebpf:"runq_hist_tgid"`
 }
 
 func (m *keplerMaps) Close() error {
 	return _KeplerClose(
 		m.ActiveProcs,
+		m.FailedInserts,
+		m.IterTgids,
+		m.LookupPids,
+		m.LookupTimes,
+		m.OffCpuSince,
+		m.ProcEvents,
+		m.RunqEnqueued,
+		m.RunqHistCpu,
+		m.RunqHistTgid,
 	)
 }
 
@@ -109,18 +200,41 @@ func (m *keplerMaps) Close() error {
 //
 // It can be passed to loadKeplerObjects or ebpf.CollectionSpec.LoadAndAssign.
 type keplerVariables struct {
+	OffCpu               *ebpf.Variable `ebpf:"off_cpu"`
+	RunqLatency          *ebpf.Variable `ebpf:"runq_latency"`
+	RunqLatencyPerTgid   *ebpf.Variable `ebpf:"runq_latency_per_tgid"`
+	UnusedLifecycleEvent *ebpf.Variable `ebpf:"unused_lifecycle_event"`
+	UnusedTaskTimes      *ebpf.Variable `ebpf:"unused_task_times"`
 }
 
 // keplerPrograms contains all programs after they have been loaded into the kernel.
 //
 // It can be passed to loadKeplerObjects or ebpf.CollectionSpec.LoadAndAssign.
 type keplerPrograms struct {
-	HandleSchedSwitch *ebpf.Program `ebpf:"handle_sched_switch"`
+	DumpActiveTasks        *ebpf.Program `ebpf:"dump_active_tasks"`
+	HandleSchedProcessExec *ebpf.Program `ebpf:"handle_sched_process_exec"`
+	HandleSchedProcessExit *ebpf.Program `ebpf:"handle_sched_process_exit"`
+	HandleSchedProcessFork *ebpf.Program `ebpf:"handle_sched_process_fork"`
+	HandleSchedSwitch      *ebpf.Program `ebpf:"handle_sched_switch"`
+	HandleSchedSwitchRaw   *ebpf.Program `ebpf:"handle_sched_switch_raw"`
+	HandleSchedSwitchTp    *ebpf.Program `ebpf:"handle_sched_switch_tp"`
+	HandleSchedWakeup      *ebpf.Program `ebpf:"handle_sched_wakeup"`
+	HandleSchedWakeupNew   *ebpf.Program `ebpf:"handle_sched_wakeup_new"`
+	LookupTasks            *ebpf.Program `ebpf:"lookup_tasks"`
 }
 
 func (p *keplerPrograms) Close() error {
 	return _KeplerClose(
+		p.DumpActiveTasks,
+		p.HandleSchedProcessExec,
+		p.HandleSchedProcessExit,
+		p.HandleSchedProcessFork,
 		p.HandleSchedSwitch,
+		p.HandleSchedSwitchRaw,
+		p.HandleSchedSwitchTp,
+		p.HandleSchedWakeup,
+		p.HandleSchedWakeupNew,
+		p.LookupTasks,
 	)
 }
 
@@ -0,0 +1,71 @@
+package ebpf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+/*
+OffCPU is the time the threads of a process spent switched out, by their
+state when switched out. A wait is accounted when the thread is switched in
+again, so a thread still off cpu is missing until it runs.
+*/
+type OffCPU struct {
+	// Sleeping is in interruptible sleep, stopped or traced
+	Sleeping time.Duration
+	// Uninterruptible is in uninterruptible sleep, mostly blocked on IO
+	Uninterruptible time.Duration
+	// Preempted is runnable, waiting on a run queue
+	Preempted time.Duration
+}
+
+// Total returns the time off cpu in every state
+func (o OffCPU) Total() time.Duration {
+	return o.Sleeping + o.Uninterruptible + o.Preempted
+}
+
+// Add adds the times of other to o
+func (o *OffCPU) Add(other OffCPU) {
+	o.Sleeping += other.Sleeping
+	o.Uninterruptible += other.Uninterruptible
+	o.Preempted += other.Preempted
+}
+
+// offCPUFrom converts active_proc.off_cpu, indexed by enum off_cpu_state
+func offCPUFrom(ns [3]uint64) OffCPU {
+	return OffCPU{
+		Sleeping:        time.Duration(ns[0]),
+		Uninterruptible: time.Duration(ns[1]),
+		Preempted:       time.Duration(ns[2]),
+	}
+}
+
+// setOffCPU sets the global variable of spec enabling the off-CPU time in
+// the sched_switch program, and sizes its map for every thread, or shrinks it
+// when disabled
+func setOffCPU(spec *ebpf.CollectionSpec, opts Options) error {
+	if err := spec.Variables["off_cpu"].Set(opts.OffCPU); err != nil {
+		return err
+	}
+	if !opts.OffCPU {
+		spec.Maps["off_cpu_since"].MaxEntries = 1
+		return nil
+	}
+	threads, err := maxThreads()
+	if err != nil {
+		return err
+	}
+	spec.Maps["off_cpu_since"].MaxEntries = threads
+	return nil
+}
+
+// checkOffCPU fails if the off-CPU time cannot be measured with attach: only
+// tp_btf gives sched_switch the next task
+func checkOffCPU(opts Options, attach AttachType) error {
+	if opts.OffCPU && attach != AttachTpBtf {
+		return fmt.Errorf("sched_switch is attached as %s, %s is needed", attach, AttachTpBtf)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package ebpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// bpffs is where Options.Pin directories are created
+const bpffs = "/sys/fs/bpf"
+
+// schedSwitchPin is the name the sched_switch link is pinned as
+const schedSwitchPin = "sched_switch"
+
+// pinnedMaps are the maps of the sched_switch program, pinned with its link
+var pinnedMaps = []string{"active_procs", "runq_enqueued", "runq_hist_cpu", "runq_hist_tgid", "off_cpu_since", "failed_inserts"}
+
+func (o Options) pinDir() string {
+	if o.Pin == "" {
+		return ""
+	}
+	return filepath.Join(bpffs, o.Pin)
+}
+
+/*
+lockPinDir creates pinDir and locks it, so a second process using the same
+pin fails instead of draining active_procs of the first. The lock is released
+when the returned file is closed, or the process exits. It returns nil
+without a pin directory.
+*/
+func lockPinDir(pinDir string) (*os.File, error) {
+	if pinDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(pinDir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create pin directory: %w", err)
+	}
+	dir, err := os.Open(pinDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open pin directory: %w", err)
+	}
+	err = unix.Flock(int(dir.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		dir.Close()
+		return nil, fmt.Errorf("pin directory %s is used by another process", pinDir)
+	}
+	if err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("cannot lock pin directory: %w", err)
+	}
+	return dir, nil
+}
+
+/*
+loadMaps loads the maps of spec into maps, but the maps of skipped, which
+are left nil. With a pin directory, the maps of the sched_switch program are
+reused from it if they are compatible with spec, and replaced otherwise.
+*/
+func loadMaps(spec *ebpf.CollectionSpec, maps *keplerMaps, skipped []string, pinDir string) error {
+	if pinDir == "" {
+		return assignMaps(spec, maps, skipped, nil)
+	}
+	for _, name := range pinnedMaps {
+		spec.Maps[name].Pinning = ebpf.PinByName
+	}
+	opts := &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: pinDir}}
+	err := assignMaps(spec, maps, skipped, opts)
+	if errors.Is(err, ebpf.ErrMapIncompatible) {
+		// pinned by another version of the program, or with other options
+		for _, name := range pinnedMaps {
+			err := os.Remove(filepath.Join(pinDir, name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("cannot remove incompatible pinned map: %w", err)
+			}
+		}
+		err = assignMaps(spec, maps, skipped, opts)
+	}
+	return err
+}
+
+/*
+assignMaps creates the maps of spec, except skipped and the sections of the
+global variables, and sets the fields of maps to them. spec.LoadAndAssign
+cannot leave fields of maps nil.
+*/
+func assignMaps(spec *ebpf.CollectionSpec, maps *keplerMaps, skipped []string, opts *ebpf.CollectionOptions) error {
+	spec = spec.Copy()
+	spec.Programs, spec.Variables = nil, nil
+	for name := range spec.Maps {
+		if strings.HasPrefix(name, ".") || slices.Contains(skipped, name) {
+			delete(spec.Maps, name)
+		}
+	}
+	if opts == nil {
+		opts = &ebpf.CollectionOptions{}
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, *opts)
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	v := reflect.ValueOf(maps).Elem()
+	for i := range v.NumField() {
+		if m := coll.DetachMap(v.Type().Field(i).Tag.Get("ebpf")); m != nil {
+			v.Field(i).Set(reflect.ValueOf(m))
+		}
+	}
+	return nil
+}
+
+// loadPinnedSchedSwitch returns the sched_switch link pinned in pinDir, nil
+// if there is none
+func loadPinnedSchedSwitch(pinDir string) (*schedSwitch, error) {
+	if pinDir == "" {
+		return nil, nil
+	}
+	l, err := link.LoadPinnedLink(filepath.Join(pinDir, schedSwitchPin), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load pinned link: %w", err)
+	}
+	info, err := l.Info()
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot get pinned link info: %w", err)
+	}
+	prog, err := ebpf.NewProgramFromID(info.Program)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot get pinned program: %w", err)
+	}
+	p := &schedSwitch{prog: prog, link: l}
+	switch prog.Type() {
+	case ebpf.Tracing:
+		p.attach = AttachTpBtf
+	case ebpf.RawTracepoint:
+		p.attach = AttachRawTracepoint
+	case ebpf.TracePoint:
+		p.attach = AttachTracepoint
+	}
+	return p, nil
+}
+
+/*
+matches tells if the program of the pinned p is the same as prog: the same
+instructions, using the same maps, with the same global variables. Program
+tags are computed by the kernel from the loaded instructions without the map
+references, so a program of another build does not match.
+*/
+func (p *schedSwitch) matches(prog *ebpf.Program, attach AttachType) bool {
+	if p.attach != attach {
+		return false
+	}
+	pinned, err := p.prog.Info()
+	if err != nil {
+		return false
+	}
+	loaded, err := prog.Info()
+	if err != nil || pinned.Tag != loaded.Tag {
+		return false
+	}
+	pinnedMaps, pinnedData, err := programMaps(pinned)
+	if err != nil {
+		return false
+	}
+	loadedMaps, loadedData, err := programMaps(loaded)
+	if err != nil {
+		return false
+	}
+	return slices.Equal(pinnedMaps, loadedMaps) && bytes.Equal(pinnedData, loadedData)
+}
+
+/*
+programMaps returns the sorted ids of the maps used by the program of info,
+and the content of its .rodata. A program gets its own .rodata, holding the
+global variables set before loading.
+*/
+func programMaps(info *ebpf.ProgramInfo) ([]ebpf.MapID, []byte, error) {
+	ids, ok := info.MapIDs()
+	if !ok {
+		return nil, nil, fmt.Errorf("map ids not available")
+	}
+	var maps []ebpf.MapID
+	var rodata []byte
+	for _, id := range ids {
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer m.Close()
+		mapInfo, err := m.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasSuffix(mapInfo.Name, ".rodata") {
+			maps = append(maps, id)
+			continue
+		}
+		rodata = make([]byte, m.ValueSize())
+		if err := m.Lookup(uint32(0), rodata); err != nil {
+			return nil, nil, err
+		}
+	}
+	slices.Sort(maps)
+	return maps, rodata, nil
+}
+
+// pinSchedSwitch pins l in pinDir, in place of the link pinned before
+func pinSchedSwitch(l link.Link, pinDir string) error {
+	path := filepath.Join(pinDir, schedSwitchPin)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot unpin previous link: %w", err)
+	}
+	if err := l.Pin(path); err != nil {
+		return fmt.Errorf("cannot pin link: %w", err)
+	}
+	return nil
+}
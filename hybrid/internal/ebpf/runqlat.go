@@ -0,0 +1,192 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/hist"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// ProcRunqLatency is the run queue latency of the threads of a process
+type ProcRunqLatency struct {
+	Pid  Pid       `json:"pid"`
+	Comm string    `json:"comm"`
+	Hist hist.Log2 `json:"hist"`
+}
+
+// RunqLatency is the time tasks waited on a run queue in an interval, in µs
+type RunqLatency struct {
+	// PerCPU is by cpu the tasks waited on, the cpus without a wait are missing
+	PerCPU map[CPUId]hist.Log2 `json:"per_cpu"`
+	// PerProcess is set with Options.RunqLatencyPerProcess, in no order
+	PerProcess []ProcRunqLatency `json:"per_process,omitempty"`
+}
+
+// All returns the latencies of every cpu
+func (r RunqLatency) All() hist.Log2 {
+	var all hist.Log2
+	for _, h := range r.PerCPU {
+		all.Add(h)
+	}
+	return all
+}
+
+// runqLatency holds the sched_wakeup links
+type runqLatency struct {
+	links      []link.Link
+	perProcess bool
+	// prev is the last reading of runq_hist_cpu, which is cumulative
+	prev []keplerRunqHist
+}
+
+func (r *runqLatency) Close() {
+	for _, l := range r.links {
+		l.Close()
+	}
+}
+
+// runqPrograms are the programs putting tasks on a run queue
+var runqPrograms = []string{"handle_sched_wakeup", "handle_sched_wakeup_new"}
+
+/*
+setRunqLatency sets the global variables of spec enabling the run queue
+latency in the sched_switch program, sizes runq_enqueued for every thread,
+and shrinks the maps of what is not measured, so they take no memory.
+*/
+func setRunqLatency(spec *ebpf.CollectionSpec, opts Options) error {
+	enabled := opts.RunqLatency || opts.RunqLatencyPerProcess
+	if err := spec.Variables["runq_latency"].Set(enabled); err != nil {
+		return err
+	}
+	if err := spec.Variables["runq_latency_per_tgid"].Set(opts.RunqLatencyPerProcess); err != nil {
+		return err
+	}
+	if !opts.RunqLatencyPerProcess {
+		spec.Maps["runq_hist_tgid"].MaxEntries = 1
+	}
+	if !enabled {
+		spec.Maps["runq_enqueued"].MaxEntries = 1
+		spec.Maps["runq_hist_cpu"].MaxEntries = 1
+		return nil
+	}
+	numCPU, err := ebpf.PossibleCPU()
+	if err != nil {
+		return err
+	}
+	spec.Maps["runq_hist_cpu"].MaxEntries = min(spec.Maps["runq_hist_cpu"].MaxEntries, uint32(numCPU))
+	threads, err := maxThreads()
+	if err != nil {
+		return err
+	}
+	spec.Maps["runq_enqueued"].MaxEntries = threads
+	return nil
+}
+
+/*
+attachRunqLatency loads and attaches the programs recording when tasks are
+put on a run queue, sched_switch recording when they leave it. Only tp_btf
+gives sched_switch the next task, so the other attach types are not
+supported. The latencies recorded before, by a pinned program, are dropped.
+*/
+func attachRunqLatency(spec *ebpf.CollectionSpec, maps *keplerMaps, attach AttachType) (*runqLatency, error) {
+	if attach != AttachTpBtf {
+		return nil, fmt.Errorf("sched_switch is attached as %s, %s is needed", attach, AttachTpBtf)
+	}
+	r := &runqLatency{perProcess: maps.RunqHistTgid.MaxEntries() > 1}
+	for _, name := range runqPrograms {
+		prog, err := loadProgram(spec, name, maps)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		l, err := link.AttachTracing(link.TracingOptions{
+			Program:    prog,
+			AttachType: ebpf.AttachTraceRawTp,
+		})
+		// the link holds the program
+		prog.Close()
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		r.links = append(r.links, l)
+	}
+	if _, err := r.drain(maps); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// DrainRunqLatency returns the run queue latency since the previous call,
+// or since Instance for the first call
+func (bm *bpfManager) DrainRunqLatency() (RunqLatency, error) {
+	if bm.runq == nil {
+		return RunqLatency{}, fmt.Errorf("run queue latency not enabled")
+	}
+	return bm.runq.drain(&bm.bpfObjs.keplerMaps)
+}
+
+func (r *runqLatency) drain(maps *keplerMaps) (RunqLatency, error) {
+	var lat RunqLatency
+	cpuMap := maps.RunqHistCpu
+	keys := make([]uint32, cpuMap.MaxEntries())
+	values := make([]keplerRunqHist, cpuMap.MaxEntries())
+	var cursor ebpf.MapBatchCursor
+	count, err := cpuMap.BatchLookup(&cursor, keys, values, nil)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return lat, fmt.Errorf("cannot read runq_hist_cpu: %w", err)
+	}
+	values = values[:count]
+	lat.PerCPU = map[CPUId]hist.Log2{}
+	for i, v := range values {
+		h := hist.Log2(slices.Clone(v.Slots[:]))
+		if i < len(r.prev) {
+			h = h.Sub(r.prev[i].Slots[:])
+		}
+		if h.Total() > 0 {
+			lat.PerCPU[CPUId(keys[i])] = h
+		}
+	}
+	r.prev = values
+
+	if !r.perProcess {
+		return lat, nil
+	}
+	lat.PerProcess, err = drainTgidHists(maps.RunqHistTgid)
+	if err != nil {
+		return lat, fmt.Errorf("cannot drain runq_hist_tgid: %w", err)
+	}
+	return lat, nil
+}
+
+// tgidBatch is the number of keys drained at once from runq_hist_tgid
+const tgidBatch = 256
+
+func drainTgidHists(m *ebpf.Map) ([]ProcRunqLatency, error) {
+	keys := make([]uint32, tgidBatch)
+	values := make([]keplerRunqTgidHist, tgidBatch)
+	var procs []ProcRunqLatency
+	var cursor ebpf.MapBatchCursor
+	for {
+		count, err := m.BatchLookupAndDelete(&cursor, keys, values, nil)
+		for i, v := range values[:count] {
+			procs = append(procs, ProcRunqLatency{
+				Pid:  keys[i],
+				Comm: commString(v.Comm),
+				Hist: hist.Log2(slices.Clone(v.Slots[:])),
+			})
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return procs, nil
+}
@@ -1,24 +1,79 @@
 //go:build ignore
 
-#include <stddef.h>
-#include <linux/types.h>
-#include <linux/bpf.h>
+#include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 
-struct task_struct {
-	int pid;
-	unsigned int tgid;
+/* Fields renamed or moved across kernel versions. Both flavors are declared
+ * here, so the program builds against the vmlinux.h of any kernel, and
+ * bpf_core_field_exists picks the one of the running kernel at load time */
+
+/* task_struct.state was renamed __state in 5.14 */
+struct task_struct___new {
+	unsigned int __state;
+} __attribute__((preserve_access_index));
+
+struct task_struct___old {
+	long state;
+	/* moved to thread_info.cpu in 5.16 */
+	unsigned int cpu;
 } __attribute__((preserve_access_index));
 
+struct thread_info___new {
+	unsigned int cpu;
+} __attribute__((preserve_access_index));
+
+static __always_inline __u32 task_state(struct task_struct *task)
+{
+    struct task_struct___new *t = (void *)task;
+
+    if (bpf_core_field_exists(t->__state))
+        return BPF_CORE_READ(t, __state);
+    return BPF_CORE_READ((struct task_struct___old *)task, state);
+}
+
+/* task_sid returns the session id of task, in the initial pid namespace */
+static __always_inline __u32 task_sid(struct task_struct *task)
+{
+    return BPF_CORE_READ(task, signal, pids[PIDTYPE_SID], numbers[0].nr);
+}
+
+static __always_inline int task_cpu(struct task_struct *task)
+{
+    struct thread_info___new *ti = (void *)&task->thread_info;
+
+    if (bpf_core_field_exists(ti->cpu))
+        return BPF_CORE_READ(ti, cpu);
+    return BPF_CORE_READ((struct task_struct___old *)task, cpu);
+}
+
+/* cpus recorded in active_proc.cpus, the cpus above are only seen as the
+ * first cpu of a process */
+#define MAX_CPUS 512
+
+/* states a thread is off cpu in, from its state when switched out */
+enum off_cpu_state {
+    OFF_CPU_SLEEPING, // interruptible sleep, stopped, traced or idle
+    OFF_CPU_UNINTERRUPTIBLE, // uninterruptible sleep, mostly waiting on IO
+    OFF_CPU_PREEMPTED, // runnable, waiting on a run queue
+    OFF_CPU_STATES,
+};
+
 /* Structure for active PID information */
 struct active_proc {
     __u32 pid; // pid in userspace, but tgid in kernel space
-    int cpu;
+    int cpu; // first cpu the process was switched out on
     char comm[16];
+    __u64 cpus[MAX_CPUS / 64]; // bitmask of the cpus it was switched out on
+    __u64 nvcsw; // voluntary switches: the process blocked
+    __u64 nivcsw; // involuntary switches: it was preempted while runnable
+    __u64 off_cpu[OFF_CPU_STATES]; // ns its threads spent off cpu, by off_cpu_state
 };
 
-/* BPF map of active PIDs with minimal info */
+/* BPF map of active PIDs with minimal info. Userspace may load it as a
+ * PERCPU_HASH or LRU_PERCPU_HASH instead, then every cpu a process ran on
+ * has its own value */
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 8192);
@@ -26,37 +81,596 @@ struct {
     __type(value, struct active_proc);
 } active_procs SEC(".maps");
 
-static inline void do_update(__u32 pid, __u32 tgid)
+/* set_cpu adds cpu to the cpus of proc. Without atomics, which need Linux
+ * 5.12, two cpus setting a bit of the same word at once may lose one of
+ * them, it is set again on the next switch of the process on that cpu */
+static __always_inline void set_cpu(struct active_proc *proc, __u32 cpu)
+{
+    if (cpu >= MAX_CPUS)
+        return;
+    __u64 bit = 1ULL << (cpu & 63);
+    __u64 *word = &proc->cpus[(cpu / 64) & (MAX_CPUS / 64 - 1)];
+    if (!(*word & bit))
+        *word |= bit;
+}
+
+/* get_proc returns the value of tgid in active_procs, added for a process
+ * seen on cpu if missing, NULL if the map is full. The comm is the one of
+ * task, or of the current task without one */
+static __always_inline struct active_proc *get_proc(__u32 tgid, __u32 cpu, struct task_struct *task)
+{
+    /* With a per-cpu map the key exists as soon as any cpu added it, and
+     * the value of this cpu is zeroed until written here */
+    struct active_proc *seen = bpf_map_lookup_elem(&active_procs, &tgid);
+    if (seen && seen->pid)
+        return seen;
+    if (!seen) {
+        struct active_proc zero = {0};
+        bpf_map_update_elem(&active_procs, &tgid, &zero, BPF_NOEXIST);
+        seen = bpf_map_lookup_elem(&active_procs, &tgid);
+        if (!seen)
+            return NULL;
+    }
+    seen->pid = tgid;
+    seen->cpu = cpu;
+    if (task)
+        BPF_CORE_READ_STR_INTO(&seen->comm, task, comm);
+    else
+        bpf_get_current_comm(&seen->comm, sizeof(seen->comm));
+    return seen;
+}
+
+/* do_update records a switch out of the thread pid of tgid, voluntary as
+ * counted by the kernel in task_struct.nvcsw */
+static __always_inline void do_update(__u32 pid, __u32 tgid, bool voluntary)
 {
     // Skip kernel threads (pid == 0), swapper gets filtered out here
     if (pid == 0)
         return;
-    
-    // Prepare minimal process info
-    struct active_proc info = {0};
-    
-    // Get CPU ID and timestamp
-    info.pid = tgid;
-    info.cpu = bpf_get_smp_processor_id();
-    bpf_get_current_comm(&info.comm, sizeof(info.comm));
-    
-    // Update active PIDs map
-    bpf_map_update_elem(&active_procs, &tgid, &info, BPF_NOEXIST);
+
+    __u32 cpu = bpf_get_smp_processor_id();
+    struct active_proc *proc = get_proc(tgid, cpu, NULL);
+    if (!proc)
+        return;
+    set_cpu(proc, cpu);
+    if (voluntary)
+        __sync_fetch_and_add(&proc->nvcsw, 1);
+    else
+        __sync_fetch_and_add(&proc->nivcsw, 1);
+}
+
+/* Inserts which failed because a map of the waiting or off cpu threads was
+ * full, by failed_insert, cumulative. Userspace sizes those maps from the
+ * number of threads the kernel allows, and warns when this grows */
+enum failed_insert {
+    FAILED_RUNQ_ENQUEUED,
+    FAILED_OFF_CPU_SINCE,
+    FAILED_INSERTS,
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, FAILED_INSERTS);
+    __type(key, __u32);
+    __type(value, __u64);
+} failed_inserts SEC(".maps");
+
+static __always_inline void count_failed_insert(__u32 map)
+{
+    __u64 *count = bpf_map_lookup_elem(&failed_inserts, &map);
+    if (count)
+        __sync_fetch_and_add(count, 1);
+}
+
+/* Run queue latency: the time a task waits on a run queue, from its wakeup
+ * or its preemption to its switch in. Set by userspace before loading, the
+ * verifier removes the code of a disabled measure */
+const volatile bool runq_latency = false;
+const volatile bool runq_latency_per_tgid = false;
+
+/* log2 buckets of µs, the last one also counts the higher latencies */
+#define RUNQ_SLOTS 32
+
+struct runq_hist {
+    __u64 slots[RUNQ_SLOTS];
+};
+
+struct runq_tgid_hist {
+    char comm[16];
+    __u64 slots[RUNQ_SLOTS];
+};
+
+/* time every waiting thread was put on a run queue, by pid. Sized by
+ * userspace, and allocated as threads are added */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __uint(max_entries, 10240);
+    __type(key, __u32);
+    __type(value, __u64);
+} runq_enqueued SEC(".maps");
+
+/* latencies by cpu the task waited on, cumulative, userspace computes the
+ * intervals so the counters are never reset under the program */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_CPUS);
+    __type(key, __u32);
+    __type(value, struct runq_hist);
+} runq_hist_cpu SEC(".maps");
+
+/* latencies by tgid, drained by userspace */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 8192);
+    __type(key, __u32);
+    __type(value, struct runq_tgid_hist);
+} runq_hist_tgid SEC(".maps");
+
+static __always_inline __u32 log2_u64(__u64 v)
+{
+    __u32 r = 0, shift;
+
+    shift = (v > 0xFFFFFFFF) << 5; v >>= shift; r |= shift;
+    shift = (v > 0xFFFF) << 4; v >>= shift; r |= shift;
+    shift = (v > 0xFF) << 3; v >>= shift; r |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; r |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; r |= shift;
+    r |= (v >> 1);
+    return r;
+}
+
+static __always_inline void runq_enqueue(struct task_struct *task)
+{
+    __u32 pid = BPF_CORE_READ(task, pid);
+    if (pid == 0)
+        return;
+    __u64 ts = bpf_ktime_get_ns();
+    if (bpf_map_update_elem(&runq_enqueued, &pid, &ts, BPF_ANY))
+        count_failed_insert(FAILED_RUNQ_ENQUEUED);
+}
+
+static __always_inline void runq_dequeue(struct task_struct *task)
+{
+    __u32 pid = BPF_CORE_READ(task, pid);
+    __u64 *ts = bpf_map_lookup_elem(&runq_enqueued, &pid);
+    if (!ts)
+        return;
+    __u64 delta = (bpf_ktime_get_ns() - *ts) / 1000;
+    bpf_map_delete_elem(&runq_enqueued, &pid);
+
+    __u32 slot = log2_u64(delta);
+    if (slot >= RUNQ_SLOTS)
+        slot = RUNQ_SLOTS - 1;
+    // the compiler indexes with the register it had before the bound check,
+    // a mask it cannot remove gives the verifier the bound
+    asm volatile("" : "+r"(slot));
+    slot &= RUNQ_SLOTS - 1;
+    __u32 cpu = bpf_get_smp_processor_id();
+    struct runq_hist *hist = bpf_map_lookup_elem(&runq_hist_cpu, &cpu);
+    if (hist)
+        __sync_fetch_and_add(&hist->slots[slot], 1);
+
+    if (!runq_latency_per_tgid)
+        return;
+    __u32 tgid = BPF_CORE_READ(task, tgid);
+    struct runq_tgid_hist *tgid_hist = bpf_map_lookup_elem(&runq_hist_tgid, &tgid);
+    if (!tgid_hist) {
+        struct runq_tgid_hist zero = {0};
+        BPF_CORE_READ_STR_INTO(&zero.comm, task, group_leader, comm);
+        bpf_map_update_elem(&runq_hist_tgid, &tgid, &zero, BPF_NOEXIST);
+        tgid_hist = bpf_map_lookup_elem(&runq_hist_tgid, &tgid);
+        if (!tgid_hist)
+            return;
+    }
+    __sync_fetch_and_add(&tgid_hist->slots[slot], 1);
+}
+
+SEC("tp_btf/sched_wakeup")
+int handle_sched_wakeup(__u64 *ctx)
+{
+    runq_enqueue((struct task_struct *)ctx[0]);
+    return 0;
+}
+
+SEC("tp_btf/sched_wakeup_new")
+int handle_sched_wakeup_new(__u64 *ctx)
+{
+    runq_enqueue((struct task_struct *)ctx[0]);
+    return 0;
+}
+
+/* Off-CPU time: the time a thread spends switched out, by its state when
+ * switched out, added to its process when it is switched in again. Set by
+ * userspace before loading */
+const volatile bool off_cpu = false;
+
+/* task states, from include/linux/sched.h */
+#define STATE_UNINTERRUPTIBLE 0x2
+#define STATE_DEAD 0x80
+#define STATE_NOLOAD 0x400
+
+struct off_cpu_start {
+    __u64 ts;
+    __u32 state; // enum off_cpu_state
+};
+
+/* switch out time of every thread off cpu, by pid. Sized by userspace, and
+ * allocated as threads are added */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __uint(max_entries, 10240);
+    __type(key, __u32);
+    __type(value, struct off_cpu_start);
+} off_cpu_since SEC(".maps");
+
+static __always_inline void off_cpu_begin(__u32 pid, __u32 state)
+{
+    // a dead task is never switched in again
+    if (pid == 0 || state & STATE_DEAD)
+        return;
+    struct off_cpu_start start = {.ts = bpf_ktime_get_ns()};
+    if (state == 0)
+        start.state = OFF_CPU_PREEMPTED;
+    // TASK_IDLE kernel threads are not waiting on anything
+    else if ((state & STATE_UNINTERRUPTIBLE) && !(state & STATE_NOLOAD))
+        start.state = OFF_CPU_UNINTERRUPTIBLE;
+    else
+        start.state = OFF_CPU_SLEEPING;
+    if (bpf_map_update_elem(&off_cpu_since, &pid, &start, BPF_ANY))
+        count_failed_insert(FAILED_OFF_CPU_SINCE);
+}
+
+static __always_inline void off_cpu_end(struct task_struct *task)
+{
+    __u32 pid = BPF_CORE_READ(task, pid);
+    struct off_cpu_start *start = bpf_map_lookup_elem(&off_cpu_since, &pid);
+    if (!start)
+        return;
+    __u64 delta = bpf_ktime_get_ns() - start->ts;
+    __u32 state = start->state;
+    bpf_map_delete_elem(&off_cpu_since, &pid);
+
+    struct active_proc *proc = get_proc(BPF_CORE_READ(task, tgid), bpf_get_smp_processor_id(), task);
+    if (!proc)
+        return;
+    if (state < OFF_CPU_STATES)
+        __sync_fetch_and_add(&proc->off_cpu[state], delta);
 }
 
 /* BTF-enabled tracepoint for sched_switch */
 SEC("tp_btf/sched_switch")
 int handle_sched_switch(__u64 *ctx)
 {
+    bool preempt = ctx[0];
     struct task_struct *prev_task;
     prev_task = (struct task_struct *)ctx[1];
-    __u32 prev_pid = prev_task->pid;
-    __u32 prev_tgid = prev_task->tgid;
-    do_update(prev_pid, prev_tgid);
+    __u32 prev_pid = BPF_CORE_READ(prev_task, pid);
+    __u32 prev_tgid = BPF_CORE_READ(prev_task, tgid);
+    __u32 prev_state = task_state(prev_task);
+    // as __schedule counts nvcsw: not preempted and not runnable
+    do_update(prev_pid, prev_tgid, !preempt && prev_state != 0);
+
+    if (runq_latency) {
+        // a preempted task waits on the run queue again
+        if (prev_state == 0)
+            runq_enqueue(prev_task);
+        runq_dequeue((struct task_struct *)ctx[2]);
+    }
+    if (off_cpu) {
+        off_cpu_begin(prev_pid, prev_state);
+        off_cpu_end((struct task_struct *)ctx[2]);
+    }
 
-    // skip next task as bpf_get_current_comm will return prev_task comm 
+    // next task is only accounted for its off-CPU time, with the comm read
+    // from its task_struct, as bpf_get_current_comm returns the prev_task comm
     return 0;
 }
 
+/* Process lifecycle: a record per process forked, exec'd or exited, the
+ * threads are skipped. The programs are only attached when userspace reads
+ * the events */
+enum lifecycle_type {
+    LIFECYCLE_FORK = 1,
+    LIFECYCLE_EXEC,
+    LIFECYCLE_EXIT,
+};
+
+struct lifecycle_event {
+    __u32 type; // enum lifecycle_type
+    __u32 pid; // tgid
+    __u32 ppid;
+    __u32 sid; // session id
+    __u32 exit_code; // wait status of an exit
+    __u64 start_time; // ns since boot
+    __u64 ts; // ns since boot of the event
+    __u64 runtime; // ns, cpu time of the whole process at an exit
+    char comm[16];
+    char filename[128]; // of an exec, as passed to execve
+};
+
+// Force emitting struct lifecycle_event into the ELF for bpf2go -type
+const struct lifecycle_event *unused_lifecycle_event __attribute__((unused));
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} proc_events SEC(".maps");
+
+/* lifecycle_reserve returns a record of the process of task, NULL if the
+ * ring buffer is full */
+static __always_inline struct lifecycle_event *lifecycle_reserve(__u32 type, struct task_struct *task)
+{
+    struct lifecycle_event *ev = bpf_ringbuf_reserve(&proc_events, sizeof(*ev), 0);
+    if (!ev)
+        return NULL;
+    ev->type = type;
+    ev->pid = BPF_CORE_READ(task, tgid);
+    ev->ppid = BPF_CORE_READ(task, real_parent, tgid);
+    ev->sid = task_sid(task);
+    ev->exit_code = 0;
+    ev->runtime = 0;
+    ev->start_time = BPF_CORE_READ(task, group_leader, start_boottime);
+    ev->ts = bpf_ktime_get_boot_ns();
+    BPF_CORE_READ_STR_INTO(&ev->comm, task, comm);
+    ev->filename[0] = 0;
+    return ev;
+}
+
+SEC("tp_btf/sched_process_fork")
+int handle_sched_process_fork(__u64 *ctx)
+{
+    struct task_struct *child = (struct task_struct *)ctx[1];
+    // a new thread shares the tgid of its parent
+    if (BPF_CORE_READ(child, pid) != BPF_CORE_READ(child, tgid))
+        return 0;
+    struct lifecycle_event *ev = lifecycle_reserve(LIFECYCLE_FORK, child);
+    if (ev)
+        bpf_ringbuf_submit(ev, 0);
+    return 0;
+}
+
+SEC("tp_btf/sched_process_exec")
+int handle_sched_process_exec(__u64 *ctx)
+{
+    struct task_struct *task = (struct task_struct *)ctx[0];
+    struct linux_binprm *bprm = (struct linux_binprm *)ctx[2];
+    struct lifecycle_event *ev = lifecycle_reserve(LIFECYCLE_EXEC, task);
+    if (!ev)
+        return 0;
+    bpf_probe_read_kernel_str(&ev->filename, sizeof(ev->filename), BPF_CORE_READ(bprm, filename));
+    bpf_ringbuf_submit(ev, 0);
+    return 0;
+}
+
+SEC("tp_btf/sched_process_exit")
+int handle_sched_process_exit(__u64 *ctx)
+{
+    struct task_struct *task = (struct task_struct *)ctx[0];
+    // the last thread of the process is exiting
+    if (BPF_CORE_READ(task, signal, live.counter) != 0)
+        return 0;
+    struct lifecycle_event *ev = lifecycle_reserve(LIFECYCLE_EXIT, task);
+    if (!ev)
+        return 0;
+    ev->exit_code = BPF_CORE_READ(task, exit_code);
+    /* the runtime of the exited threads, this last one adds its own
+     * later. /proc scales utime and stime to add up to it */
+    ev->runtime = BPF_CORE_READ(task, signal, sum_sched_runtime) +
+                  BPF_CORE_READ(task, se.sum_exec_runtime);
+    bpf_ringbuf_submit(ev, 0);
+    return 0;
+}
+
+/* Fallbacks for kernels without BTF or tp_btf, tried in this order. The
+ * tracepoint fires before the switch, so the current task is still prev,
+ * and neither reads kernel structs, which would need CO-RE and kernel BTF */
+
+/* The state of prev is only an argument since Linux 5.18, so a task giving
+ * up the cpu while runnable (sched_yield) counts as voluntary here */
+SEC("raw_tracepoint/sched_switch")
+int handle_sched_switch_raw(struct bpf_raw_tracepoint_args *ctx)
+{
+    // args[0] is preempt, read without the vmlinux.h type, which is relocated
+    bool preempt = ((__u64 *)ctx)[0];
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    do_update((__u32)pid_tgid, pid_tgid >> 32, !preempt);
+    return 0;
+}
+
+/* Format of the sched_switch tracepoint, from
+ * /sys/kernel/tracing/events/sched/sched_switch/format, stable across
+ * kernel versions */
+struct sched_switch_args {
+    __u64 common;
+    char prev_comm[16];
+    int prev_pid;
+    int prev_prio;
+    long prev_state;
+    char next_comm[16];
+    int next_pid;
+    int next_prio;
+};
+
+/* prev_state of a preempted task is TASK_REPORT_MAX (0x100) or above */
+#define TASK_REPORT_MAX 0x100
+
+SEC("tracepoint/sched/sched_switch")
+int handle_sched_switch_tp(struct sched_switch_args *ctx)
+{
+    long state = ctx->prev_state;
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    do_update((__u32)pid_tgid, pid_tgid >> 32, state != 0 && state < TASK_REPORT_MAX);
+    return 0;
+}
+
+/* tgids of the processes dump_active_tasks reports, written by userspace
+ * from the drained active_procs before every run of the iterator */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 8192);
+    __type(key, __u32);
+    __type(value, __u8);
+} iter_tgids SEC(".maps");
+
+/* cpu times of one task, written by dump_active_tasks, or of a whole
+ * process, written by lookup_tasks */
+struct task_times {
+    __u32 tgid;
+    __u32 pid;
+    __u64 utime; // ns, the main thread adds the exited threads of the process
+    __u64 stime;
+    /* ns on cpu, exact where utime and stime are sampled at ticks, and
+     * which /proc scales them to add up to */
+    __u64 runtime;
+    __u64 start_time; // ns since boot, of the task
+    __u32 ppid;
+    __u32 state;
+    int cpu;
+    __u32 sid; // session id
+    char comm[16];
+};
+
+// Force emitting struct task_times into the ELF for bpf2go -type
+const struct task_times *unused_task_times __attribute__((unused));
+
+/* fill_task_times fills the cpu times of the thread task and the fields of
+ * its process */
+static __always_inline void fill_task_times(struct task_times *times, struct task_struct *task)
+{
+    times->tgid = BPF_CORE_READ(task, tgid);
+    times->pid = BPF_CORE_READ(task, pid);
+    times->utime = BPF_CORE_READ(task, utime);
+    times->stime = BPF_CORE_READ(task, stime);
+    times->runtime = BPF_CORE_READ(task, se.sum_exec_runtime);
+    times->start_time = BPF_CORE_READ(task, start_boottime);
+    times->ppid = BPF_CORE_READ(task, real_parent, tgid);
+    times->state = task_state(task) | BPF_CORE_READ(task, exit_state);
+    times->cpu = task_cpu(task);
+    times->sid = task_sid(task);
+    BPF_CORE_READ_STR_INTO(&times->comm, task, comm);
+}
+
+/* Task iterator writing the cpu times of the tasks of iter_tgids to the
+ * seq_file, so the hybrid approach needs no /proc reads */
+SEC("iter/task")
+int dump_active_tasks(struct bpf_iter__task *ctx)
+{
+    struct seq_file *seq = ctx->meta->seq;
+    struct task_struct *task = ctx->task;
+    if (task == NULL)
+        return 0;
+
+    __u32 tgid = BPF_CORE_READ(task, tgid);
+    if (!bpf_map_lookup_elem(&iter_tgids, &tgid))
+        return 0;
+
+    struct task_times times = {0};
+    fill_task_times(&times, task);
+    if (times.pid == tgid) {
+        times.utime += BPF_CORE_READ(task, signal, utime);
+        times.stime += BPF_CORE_READ(task, signal, stime);
+        times.runtime += BPF_CORE_READ(task, signal, sum_sched_runtime);
+    }
+
+    bpf_seq_write(seq, &times, sizeof(times));
+    return 0;
+}
+
+/* Inputs and outputs of lookup_tasks, at the same index up to the number of
+ * entries given in struct task_lookup_args */
+#define MAX_LOOKUP_PIDS 8192
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_LOOKUP_PIDS);
+    __type(key, __u32);
+    __type(value, __u32);
+} lookup_pids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_LOOKUP_PIDS);
+    __type(key, __u32);
+    __type(value, struct task_times);
+} lookup_times SEC(".maps");
+
+/* context of lookup_tasks, passed with BPF_PROG_TEST_RUN */
+struct task_lookup_args {
+    __u32 nr_pids; // tgids written to lookup_pids
+    /* processes written to lookup_times, counted in the context rather
+     * than on the stack so the verifier does not track it through the loop */
+    __u32 nr_found;
+};
+
+/* open-coded iterators and kfuncs, Linux 6.7 or later */
+extern struct task_struct *bpf_task_from_pid(int pid) __ksym;
+extern void bpf_task_release(struct task_struct *p) __ksym;
+extern void bpf_rcu_read_lock(void) __ksym;
+extern void bpf_rcu_read_unlock(void) __ksym;
+extern int bpf_iter_num_new(struct bpf_iter_num *it, int start, int end) __ksym;
+extern int *bpf_iter_num_next(struct bpf_iter_num *it) __ksym;
+extern void bpf_iter_num_destroy(struct bpf_iter_num *it) __ksym;
+extern int bpf_iter_task_new(struct bpf_iter_task *it, struct task_struct *task, unsigned int flags) __ksym;
+extern struct task_struct *bpf_iter_task_next(struct bpf_iter_task *it) __ksym;
+extern void bpf_iter_task_destroy(struct bpf_iter_task *it) __ksym;
+
+/* Syscall program run by userspace with the tgids of the active processes
+ * in lookup_pids: looks every process up with bpf_task_from_pid and writes
+ * the cpu times of its threads, exited ones included, to lookup_times.
+ * Returns the number of processes written, processes which exited are
+ * skipped */
+SEC("syscall")
+int lookup_tasks(struct task_lookup_args *args)
+{
+    struct bpf_iter_num it;
+    __u32 nr_pids = args->nr_pids;
+    int *i;
+
+    args->nr_found = 0;
+    if (nr_pids > MAX_LOOKUP_PIDS)
+        nr_pids = MAX_LOOKUP_PIDS;
+    bpf_iter_num_new(&it, 0, nr_pids);
+    while ((i = bpf_iter_num_next(&it))) {
+        __u32 key = *i;
+        __u32 *tgid = bpf_map_lookup_elem(&lookup_pids, &key);
+        if (!tgid)
+            continue;
+        struct task_struct *task = bpf_task_from_pid(*tgid);
+        if (!task)
+            continue;
+
+        __u32 found = args->nr_found;
+        struct task_times *times = bpf_map_lookup_elem(&lookup_times, &found);
+        // the pid of an exited process may be reused by a thread
+        if (!times || BPF_CORE_READ(task, pid) != BPF_CORE_READ(task, tgid)) {
+            bpf_task_release(task);
+            continue;
+        }
+
+        bpf_rcu_read_lock();
+        fill_task_times(times, task);
+        times->utime = BPF_CORE_READ(task, signal, utime);
+        times->stime = BPF_CORE_READ(task, signal, stime);
+        times->runtime = BPF_CORE_READ(task, signal, sum_sched_runtime);
+
+        struct bpf_iter_task threads;
+        struct task_struct *thread;
+        bpf_iter_task_new(&threads, task, BPF_TASK_ITER_PROC_THREADS);
+        while ((thread = bpf_iter_task_next(&threads))) {
+            times->utime += BPF_CORE_READ(thread, utime);
+            times->stime += BPF_CORE_READ(thread, stime);
+            times->runtime += BPF_CORE_READ(thread, se.sum_exec_runtime);
+        }
+        bpf_iter_task_destroy(&threads);
+        bpf_rcu_read_unlock();
+
+        bpf_task_release(task);
+        args->nr_found = found + 1;
+    }
+    bpf_iter_num_destroy(&it);
+    return args->nr_found;
+}
 
 char LICENSE[] SEC("license") = "GPL";
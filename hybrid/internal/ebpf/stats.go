@@ -0,0 +1,67 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const bpfStatsSysctl = "/proc/sys/kernel/bpf_stats_enabled"
+
+// ProgStats are the kernel run statistics of the sched_switch program
+type ProgStats struct {
+	RunCount uint64
+	RunTime  time.Duration
+}
+
+// sysctlStats restores kernel.bpf_stats_enabled on Close
+type sysctlStats struct {
+	prev []byte
+}
+
+func (s *sysctlStats) Close() error {
+	return os.WriteFile(bpfStatsSysctl, s.prev, 0o644)
+}
+
+/*
+EnableStats makes the kernel account run time and run count of all bpf
+programs, until the returned io.Closer is closed. BPF_ENABLE_STATS is used
+when available (5.8+), otherwise the kernel.bpf_stats_enabled sysctl is set.
+*/
+func EnableStats() (io.Closer, error) {
+	closer, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+	if err == nil {
+		return closer, nil
+	}
+	prev, sysctlErr := os.ReadFile(bpfStatsSysctl)
+	if sysctlErr == nil {
+		sysctlErr = os.WriteFile(bpfStatsSysctl, []byte("1"), 0o644)
+	}
+	if sysctlErr != nil {
+		return nil, fmt.Errorf("cannot enable bpf stats: %w", errors.Join(err, sysctlErr))
+	}
+	return &sysctlStats{prev: prev}, nil
+}
+
+// ProgStats returns the run statistics of the sched_switch program, which
+// are zero unless stats are enabled
+func (bm *bpfManager) ProgStats() (ProgStats, error) {
+	info, err := bm.schedSwitch.prog.Info()
+	if err != nil {
+		return ProgStats{}, fmt.Errorf("cannot get program info: %w", err)
+	}
+	runCount, ok := info.RunCount()
+	if !ok {
+		return ProgStats{}, fmt.Errorf("run count not available")
+	}
+	runTime, ok := info.Runtime()
+	if !ok {
+		return ProgStats{}, fmt.Errorf("run time not available")
+	}
+	return ProgStats{RunCount: runCount, RunTime: runTime}, nil
+}
@@ -0,0 +1,246 @@
+package ebpf
+
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// ProcTimes is the cpu time of a process, read in the kernel instead of /proc
+type ProcTimes struct {
+	Pid  Pid
+	Ppid Pid
+	// Session is the session id
+	Session Pid
+	Comm    string
+	// State is the state letter of the main thread, as in /proc/<pid>/stat
+	State byte
+	// Cpu the main thread last ran on
+	Cpu CPUId
+	// Utime and Stime are in ns, and include the exited threads. They are
+	// scaled to add up to the runtime of the process, as /proc does
+	Utime uint64
+	Stime uint64
+	// StartTime is the time the process started, in ns since boot
+	StartTime uint64
+}
+
+const taskTimesSize = int(unsafe.Sizeof(keplerTaskTimes{}))
+
+// strategyMaps are the maps of the task iterator and of lookup_tasks, which
+// are only loaded with their program by LoadTaskIter and LoadLookupTasks
+var strategyMaps = []string{"iter_tgids", "lookup_pids", "lookup_times"}
+
+// LoadTaskIter loads and attaches the dump_active_tasks iterator used by IterProcTimes
+func (bm *bpfManager) LoadTaskIter() error {
+	if bm.taskIter != nil {
+		return nil
+	}
+	var loaded struct {
+		DumpActiveTasks *ebpf.Program `ebpf:"dump_active_tasks"`
+		IterTgids       *ebpf.Map     `ebpf:"iter_tgids"`
+	}
+	if err := bm.spec.LoadAndAssign(&loaded, nil); err != nil {
+		return fmt.Errorf("Failed to load dump_active_tasks: %v", err)
+	}
+	it, err := link.AttachIter(link.IterOptions{
+		Program: loaded.DumpActiveTasks,
+	})
+	if err != nil {
+		loaded.DumpActiveTasks.Close()
+		loaded.IterTgids.Close()
+		return fmt.Errorf("Failed to attach task iterator: %v", err)
+	}
+	bm.bpfObjs.DumpActiveTasks = loaded.DumpActiveTasks
+	bm.bpfObjs.IterTgids = loaded.IterTgids
+	bm.taskIter = it
+	return nil
+}
+
+/*
+IterProcTimes returns the cpu times of pids, read by the dump_active_tasks
+task iterator. Processes which exited are missing from the result. iter_tgids
+bounds the processes of one run of the iterator, more pids take several runs.
+*/
+func (bm *bpfManager) IterProcTimes(pids []Pid) ([]ProcTimes, error) {
+	if bm.taskIter == nil {
+		return nil, fmt.Errorf("dump_active_tasks not loaded")
+	}
+	times := make([]ProcTimes, 0, len(pids))
+	for batch := range slices.Chunk(pids, int(bm.bpfObjs.IterTgids.MaxEntries())) {
+		batchTimes, err := bm.iterProcTimes(batch)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, batchTimes...)
+	}
+	return times, nil
+}
+
+// iterProcTimes runs the iterator over pids, no more than iter_tgids holds
+func (bm *bpfManager) iterProcTimes(pids []Pid) ([]ProcTimes, error) {
+	tgids := bm.bpfObjs.IterTgids
+	if _, err := tgids.BatchUpdate(pids, make([]uint8, len(pids)), nil); err != nil {
+		return nil, fmt.Errorf("cannot write iter_tgids: %w", err)
+	}
+	defer func() {
+		// the iterator does not remove anything, so all keys are there
+		tgids.BatchDelete(pids, nil)
+	}()
+
+	r, err := bm.taskIter.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open task iterator: %w", err)
+	}
+	defer r.Close()
+	bm.iterBuf.Reset()
+	if _, err := bm.iterBuf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("cannot read task iterator: %w", err)
+	}
+	data := bm.iterBuf.Bytes()
+	if len(data) < taskTimesSize {
+		return nil, nil
+	}
+	tasks := unsafe.Slice((*keplerTaskTimes)(unsafe.Pointer(&data[0])), len(data)/taskTimesSize)
+	return sumTaskTimes(tasks, len(pids)), nil
+}
+
+// LoadLookupTasks loads the lookup_tasks program used by LookupProcTimes
+func (bm *bpfManager) LoadLookupTasks() error {
+	if bm.bpfObjs.LookupTasks != nil {
+		return nil
+	}
+	var loaded struct {
+		LookupTasks *ebpf.Program `ebpf:"lookup_tasks"`
+		LookupPids  *ebpf.Map     `ebpf:"lookup_pids"`
+		LookupTimes *ebpf.Map     `ebpf:"lookup_times"`
+	}
+	if err := bm.spec.LoadAndAssign(&loaded, nil); err != nil {
+		return fmt.Errorf("Failed to load lookup_tasks (needs Linux 6.7 or later): %v", err)
+	}
+	bm.bpfObjs.LookupTasks = loaded.LookupTasks
+	bm.bpfObjs.LookupPids = loaded.LookupPids
+	bm.bpfObjs.LookupTimes = loaded.LookupTimes
+	return nil
+}
+
+/*
+LookupProcTimes returns the cpu times of pids, looked up one by one by the
+lookup_tasks syscall program. Processes which exited are missing from the
+result. lookup_pids bounds the processes of one run, more pids take several
+runs.
+*/
+func (bm *bpfManager) LookupProcTimes(pids []Pid) ([]ProcTimes, error) {
+	if bm.bpfObjs.LookupTasks == nil {
+		return nil, fmt.Errorf("lookup_tasks not loaded")
+	}
+	times := make([]ProcTimes, 0, len(pids))
+	for batch := range slices.Chunk(pids, int(bm.bpfObjs.LookupPids.MaxEntries())) {
+		batchTimes, err := bm.lookupProcTimes(batch)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, batchTimes...)
+	}
+	return times, nil
+}
+
+// lookupProcTimes runs lookup_tasks over pids, no more than lookup_pids holds
+func (bm *bpfManager) lookupProcTimes(pids []Pid) ([]ProcTimes, error) {
+	keys := make([]uint32, len(pids))
+	for i := range keys {
+		keys[i] = uint32(i)
+	}
+	if _, err := bm.bpfObjs.LookupPids.BatchUpdate(keys, pids, nil); err != nil {
+		return nil, fmt.Errorf("cannot write lookup_pids: %w", err)
+	}
+
+	args := keplerTaskLookupArgs{NrPids: uint32(len(pids))}
+	// the program returns the number of processes found
+	found, err := bm.bpfObjs.LookupTasks.Run(&ebpf.RunOptions{Context: args})
+	if err != nil {
+		return nil, fmt.Errorf("cannot run lookup_tasks: %w", err)
+	}
+	if found == 0 {
+		return nil, nil
+	}
+
+	tasks := make([]keplerTaskTimes, found)
+	var cursor ebpf.MapBatchCursor
+	if _, err := bm.bpfObjs.LookupTimes.BatchLookup(&cursor, keys[:found], tasks, nil); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil, fmt.Errorf("cannot read lookup_times: %w", err)
+	}
+	return sumTaskTimes(tasks, len(tasks)), nil
+}
+
+// sumTaskTimes sums task_times records per process
+func sumTaskTimes(tasks []keplerTaskTimes, procs int) []ProcTimes {
+	times := make([]ProcTimes, 0, procs)
+	runtimes := make([]uint64, 0, procs)
+	index := make(map[Pid]int, procs)
+	for _, task := range tasks {
+		i, ok := index[task.Tgid]
+		if !ok {
+			i = len(times)
+			index[task.Tgid] = i
+			times = append(times, ProcTimes{Pid: task.Tgid})
+			runtimes = append(runtimes, 0)
+		}
+		t := &times[i]
+		t.Utime += task.Utime
+		t.Stime += task.Stime
+		runtimes[i] += task.Runtime
+		// the main thread stands for the process
+		if task.Pid == task.Tgid {
+			t.Ppid = task.Ppid
+			t.Session = task.Sid
+			t.Comm = C.GoString((*C.char)(unsafe.Pointer(&task.Comm)))
+			t.State = taskState(task.State)
+			t.Cpu = task.Cpu
+			t.StartTime = task.StartTime
+		}
+	}
+	for i := range times {
+		times[i].Utime, times[i].Stime = scaleTimes(times[i].Utime, times[i].Stime, runtimes[i])
+	}
+	return times
+}
+
+/*
+scaleTimes scales utime and stime, sampled at ticks, to add up to rtime, the
+exact runtime, keeping their ratio, as cputime_adjust does for /proc. The
+kernel also keeps each of them from going backwards, which needs the
+previous reading of the process, so they may differ from /proc by a tick,
+but their sum is the same.
+*/
+func scaleTimes(utime, stime, rtime uint64) (uint64, uint64) {
+	switch {
+	case stime == 0:
+		return rtime, 0
+	case utime == 0:
+		return 0, rtime
+	}
+	// stime <= utime + stime, so the quotient fits
+	hi, lo := bits.Mul64(stime, rtime)
+	stime, _ = bits.Div64(hi, lo, utime+stime)
+	return rtime - stime, stime
+}
+
+// taskState returns the state letter /proc/<pid>/stat shows for a kernel task state
+func taskState(state uint32) byte {
+	const (
+		taskReport = 0x7f  // states reported to userspace
+		taskIdle   = 0x402 // TASK_UNINTERRUPTIBLE | TASK_NOLOAD
+	)
+	if state == taskIdle {
+		return 'I'
+	}
+	return "RSDTtXZP"[bits.Len32(state&taskReport)]
+}
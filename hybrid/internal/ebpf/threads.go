@@ -0,0 +1,51 @@
+package ebpf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FailedInserts counts the threads not measured because runq_enqueued or
+// off_cpu_since was full, since the maps were created
+type FailedInserts struct {
+	// RunqEnqueued are wakeups whose run queue latency is missing
+	RunqEnqueued uint64
+	// OffCPUSince are switches out whose off-cpu time is missing
+	OffCPUSince uint64
+}
+
+// FailedInserts returns the failed inserts counted by the programs
+func (bm *bpfManager) FailedInserts() (FailedInserts, error) {
+	var counts [2]uint64
+	for i := range counts {
+		if err := bm.bpfObjs.FailedInserts.Lookup(uint32(i), &counts[i]); err != nil {
+			return FailedInserts{}, fmt.Errorf("cannot read failed_inserts: %w", err)
+		}
+	}
+	return FailedInserts{RunqEnqueued: counts[0], OffCPUSince: counts[1]}, nil
+}
+
+/*
+maxThreads returns the number of threads the kernel allows, the lower of
+kernel.threads-max and kernel.pid_max, so the maps holding a value per thread
+never miss one.
+*/
+func maxThreads() (uint32, error) {
+	var limit uint64
+	for _, name := range []string{"threads-max", "pid_max"} {
+		data, err := os.ReadFile("/proc/sys/kernel/" + name)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad kernel.%s: %w", name, err)
+		}
+		if limit == 0 || n < limit {
+			limit = n
+		}
+	}
+	return uint32(limit), nil
+}
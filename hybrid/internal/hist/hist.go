@@ -0,0 +1,101 @@
+package hist
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+Log2 is a histogram counting values in power of 2 buckets: bucket 0 counts
+the values 0 and 1, and bucket i the values in [2^i, 2^(i+1)). The last
+bucket also counts the values above it.
+*/
+type Log2 []uint64
+
+// Add adds the counts of o to h, which grows to the buckets of o
+func (h *Log2) Add(o Log2) {
+	if len(o) > len(*h) {
+		*h = append(*h, make(Log2, len(o)-len(*h))...)
+	}
+	for i, n := range o {
+		(*h)[i] += n
+	}
+}
+
+// Sub returns the counts of h since prev, an earlier reading of the same
+// cumulative histogram
+func (h Log2) Sub(prev Log2) Log2 {
+	delta := make(Log2, len(h))
+	for i, n := range h {
+		if i < len(prev) && prev[i] <= n {
+			n -= prev[i]
+		}
+		delta[i] = n
+	}
+	return delta
+}
+
+// Total returns the number of values counted
+func (h Log2) Total() uint64 {
+	var total uint64
+	for _, n := range h {
+		total += n
+	}
+	return total
+}
+
+// Bounds returns the lowest and highest value of bucket i
+func Bounds(i int) (uint64, uint64) {
+	if i == 0 {
+		return 0, 1
+	}
+	return 1 << i, 1<<(i+1) - 1
+}
+
+// Percentile returns the highest value of the bucket holding the p-th
+// percentile, 0 if h is empty
+func (h Log2) Percentile(p float64) uint64 {
+	total := h.Total()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(total))
+	var seen uint64
+	for i, n := range h {
+		seen += n
+		if seen > rank || seen == total {
+			_, high := Bounds(i)
+			return high
+		}
+	}
+	return 0
+}
+
+const barWidth = 40
+
+// Print writes h as bcc runqlat does, from the first to the last non empty
+// bucket, the values being in unit
+func (h Log2) Print(w io.Writer, unit string) {
+	first, last := -1, -1
+	var peak uint64
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		peak = max(peak, n)
+	}
+	fmt.Fprintf(w, "%20s : %-8s %s\n", unit, "count", "distribution")
+	if first < 0 {
+		return
+	}
+	for i := first; i <= last; i++ {
+		low, high := Bounds(i)
+		stars := int(h[i] * barWidth / peak)
+		fmt.Fprintf(w, "%10d -> %-7d : %-8d |%-*s|\n", low, high, h[i], barWidth, strings.Repeat("*", stars))
+	}
+}
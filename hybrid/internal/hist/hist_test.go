@@ -0,0 +1,58 @@
+package hist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Log2(t *testing.T) {
+	var h Log2
+	h.Add(Log2{1, 0, 2})
+	h.Add(Log2{0, 1, 1, 4})
+	if diff := cmp.Diff(Log2{1, 1, 3, 4}, h); diff != "" {
+		t.Errorf("Add() diff: %v", diff)
+	}
+	if got := h.Total(); got != 9 {
+		t.Errorf("Total() got: %v, want: 9", got)
+	}
+	if diff := cmp.Diff(Log2{0, 1, 1, 4}, h.Sub(Log2{1, 0, 2})); diff != "" {
+		t.Errorf("Sub() diff: %v", diff)
+	}
+}
+
+func Test_Percentile(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Log2
+		p    float64
+		want uint64
+	}{
+		{name: "empty", h: Log2{}, p: 50, want: 0},
+		{name: "median in bucket 0", h: Log2{3, 1, 1}, p: 50, want: 1},
+		{name: "median in bucket 2", h: Log2{1, 1, 3}, p: 50, want: 7},
+		{name: "p99 is the last bucket", h: Log2{90, 9, 0, 1}, p: 99, want: 15},
+		{name: "p100", h: Log2{1, 0, 1, 0}, p: 100, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.Percentile(tt.p); got != tt.want {
+				t.Errorf("Percentile() got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Print(t *testing.T) {
+	var b strings.Builder
+	Log2{0, 2, 0, 1, 0}.Print(&b, "usecs")
+	want := `               usecs : count    distribution
+         2 -> 3       : 2        |****************************************|
+         4 -> 7       : 0        |                                        |
+         8 -> 15      : 1        |********************                    |
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("Print() diff: %v", diff)
+	}
+}
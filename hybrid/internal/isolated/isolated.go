@@ -16,40 +16,41 @@ type procsTracker struct {
 	previousProcs map[Pid]ebpf.ActiveProc
 }
 
-var (
-	procs = map[CPUId]procsTracker{}
-	cpus  = map[Pid]CPUId{}
-)
+var procs = map[CPUId]*procsTracker{}
 
 func Init(isolated []CPUId) {
+	procs = map[CPUId]*procsTracker{}
 	for _, cpu := range isolated {
-		procs[cpu] = procsTracker{
+		procs[cpu] = &procsTracker{
 			currentProcs:  map[Pid]ebpf.ActiveProc{},
 			previousProcs: map[Pid]ebpf.ActiveProc{},
 		}
 	}
 }
 
+// StartTracking tracks proc on the isolated cpu, a process which ran on
+// several isolated cpus is tracked on each of them
 func StartTracking(cpu CPUId, proc ebpf.ActiveProc) {
 	t := procs[cpu]
 	t.currentProcs[proc.Pid] = proc
-	cpus[proc.Pid] = cpu
 }
 
 func RemoveTracking(pid Pid) {
-	cpu := cpus[pid]
-	delete(cpus, pid)
-	pt := procs[cpu]
-	delete(pt.currentProcs, pid)
-	delete(pt.previousProcs, pid)
+	for _, t := range procs {
+		delete(t.currentProcs, pid)
+		delete(t.previousProcs, pid)
+	}
 }
 
+// ActiveProcs returns the processes of every isolated cpu, once each
 func ActiveProcs() []ebpf.ActiveProc {
-	activeProcs := []ebpf.ActiveProc{}
+	activeProcs := map[Pid]ebpf.ActiveProc{}
 	for cpu := range maps.Keys(procs) {
-		activeProcs = append(activeProcs, ActiveProcsForIsolatedCpu(cpu)...)
+		for _, proc := range ActiveProcsForIsolatedCpu(cpu) {
+			activeProcs[proc.Pid] = proc
+		}
 	}
-	return activeProcs
+	return slices.Collect(maps.Values(activeProcs))
 }
 
 func ActiveProcsForIsolatedCpu(cpu CPUId) []ebpf.ActiveProc {
@@ -0,0 +1,49 @@
+package isolated
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+func pids(procs []ebpf.ActiveProc) []Pid {
+	var pids []Pid
+	for _, p := range procs {
+		pids = append(pids, p.Pid)
+	}
+	slices.Sort(pids)
+	return pids
+}
+
+func Test_Tracking(t *testing.T) {
+	Init([]CPUId{2, 3})
+	both := ebpf.ActiveProc{Pid: 10, Cpu: 1, Cpus: []CPUId{1, 2, 3}}
+	one := ebpf.ActiveProc{Pid: 11, Cpu: 3, Cpus: []CPUId{3}}
+	StartTracking(2, both)
+	StartTracking(3, both)
+	StartTracking(3, one)
+
+	// a process tracked on two cpus is returned once
+	if diff := cmp.Diff([]Pid{10, 11}, pids(ActiveProcs())); diff != "" {
+		t.Errorf("ActiveProcs() diff: %v", diff)
+	}
+	// without activity in the interval, the processes of the previous one are kept
+	if diff := cmp.Diff([]Pid{10, 11}, pids(ActiveProcs())); diff != "" {
+		t.Errorf("ActiveProcs() without activity diff: %v", diff)
+	}
+	// activity on cpu 3 only replaces the processes of cpu 3
+	StartTracking(3, one)
+	if diff := cmp.Diff([]Pid{10, 11}, pids(ActiveProcs())); diff != "" {
+		t.Errorf("ActiveProcs() with activity diff: %v", diff)
+	}
+	if diff := cmp.Diff([]Pid{11}, pids(ActiveProcsForIsolatedCpu(3))); diff != "" {
+		t.Errorf("ActiveProcsForIsolatedCpu(3) diff: %v", diff)
+	}
+	RemoveTracking(10)
+	if diff := cmp.Diff([]Pid{11}, pids(ActiveProcs())); diff != "" {
+		t.Errorf("ActiveProcs() after RemoveTracking diff: %v", diff)
+	}
+}
@@ -0,0 +1,124 @@
+package proctable
+
+import (
+	"sync"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// Proc is a live process of the table
+type Proc struct {
+	Pid     Pid
+	Ppid    Pid
+	Session Pid
+	Comm    string
+	// Exe is the file of its last exec, or of the exec of its parent, empty
+	// if none was seen
+	Exe string
+	// StartTime is in ns since boot
+	StartTime uint64
+}
+
+// Counts are the events applied to a table
+type Counts struct {
+	Forks int
+	Execs int
+	Exits int
+}
+
+/*
+Table holds the live processes, from the process lifecycle events instead
+of scanning /proc. Processes started before the events were read are only
+known once Seen, and the children of an exited process keep its pid as ppid
+until their next event, as their new parent is not reported.
+*/
+type Table struct {
+	mu     sync.Mutex
+	procs  map[Pid]Proc
+	counts Counts
+	// exits are the exit events not taken yet, when kept
+	keepExits bool
+	exits     []ebpf.ProcEvent
+}
+
+// New returns an empty table, keepExits keeps the exit events for TakeExits
+func New(keepExits bool) *Table {
+	return &Table{procs: map[Pid]Proc{}, keepExits: keepExits}
+}
+
+// Run applies events until the channel is closed
+func (t *Table) Run(events <-chan ebpf.ProcEvent) {
+	for ev := range events {
+		t.Apply(ev)
+	}
+}
+
+// Apply updates the table with ev
+func (t *Table) Apply(ev ebpf.ProcEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch ev.Type {
+	case ebpf.ProcFork:
+		t.counts.Forks++
+		// a pid already there is reused, its exit was missed
+		p := Proc{Pid: ev.Pid, Ppid: ev.Ppid, Session: ev.Session, Comm: ev.Comm, StartTime: ev.StartTime}
+		if parent, ok := t.procs[ev.Ppid]; ok {
+			p.Exe = parent.Exe
+		}
+		t.procs[ev.Pid] = p
+	case ebpf.ProcExec:
+		t.counts.Execs++
+		t.procs[ev.Pid] = Proc{Pid: ev.Pid, Ppid: ev.Ppid, Session: ev.Session, Comm: ev.Comm, Exe: ev.Exe, StartTime: ev.StartTime}
+	case ebpf.ProcExit:
+		t.counts.Exits++
+		delete(t.procs, ev.Pid)
+		if t.keepExits {
+			t.exits = append(t.exits, ev)
+		}
+	}
+}
+
+// Seen adds p if its pid is not in the table, for a process started
+// before the events were read
+func (t *Table) Seen(p Proc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.procs[p.Pid]; !ok {
+		t.procs[p.Pid] = p
+	}
+}
+
+// Get returns the process pid
+func (t *Table) Get(pid Pid) (Proc, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.procs[pid]
+	return p, ok
+}
+
+// Len returns the number of processes in the table
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.procs)
+}
+
+// TakeCounts returns the events applied since the previous call
+func (t *Table) TakeCounts() Counts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := t.counts
+	t.counts = Counts{}
+	return counts
+}
+
+// TakeExits returns the exit events applied since the previous call, with
+// the cpu time of the processes
+func (t *Table) TakeExits() []ebpf.ProcEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exits := t.exits
+	t.exits = nil
+	return exits
+}
@@ -0,0 +1,102 @@
+package proctable
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+func Test_Apply(t *testing.T) {
+	tests := []struct {
+		name string
+		seen []Proc
+		// seenLast applies seen after events
+		seenLast   bool
+		events     []ebpf.ProcEvent
+		want       map[Pid]Proc
+		wantCounts Counts
+	}{
+		{
+			name: "fork inherits the exe of the parent",
+			seen: []Proc{{Pid: 1, Comm: "init", Exe: "/sbin/init"}},
+			events: []ebpf.ProcEvent{
+				{Type: ebpf.ProcFork, Pid: 10, Ppid: 1, Comm: "init", StartTime: 100},
+			},
+			want: map[Pid]Proc{
+				1:  {Pid: 1, Comm: "init", Exe: "/sbin/init"},
+				10: {Pid: 10, Ppid: 1, Comm: "init", Exe: "/sbin/init", StartTime: 100},
+			},
+			wantCounts: Counts{Forks: 1},
+		},
+		{
+			name: "exec replaces comm and exe",
+			events: []ebpf.ProcEvent{
+				{Type: ebpf.ProcFork, Pid: 10, Ppid: 1, Comm: "bash", StartTime: 100},
+				{Type: ebpf.ProcExec, Pid: 10, Ppid: 1, Comm: "ls", Exe: "/bin/ls", StartTime: 100},
+			},
+			want: map[Pid]Proc{
+				10: {Pid: 10, Ppid: 1, Comm: "ls", Exe: "/bin/ls", StartTime: 100},
+			},
+			wantCounts: Counts{Forks: 1, Execs: 1},
+		},
+		{
+			name: "exit removes",
+			events: []ebpf.ProcEvent{
+				{Type: ebpf.ProcFork, Pid: 10, Ppid: 1, Comm: "bash", StartTime: 100},
+				{Type: ebpf.ProcExit, Pid: 10, Ppid: 1, Comm: "bash", StartTime: 100},
+			},
+			want:       map[Pid]Proc{},
+			wantCounts: Counts{Forks: 1, Exits: 1},
+		},
+		{
+			name: "seen does not replace an event",
+			events: []ebpf.ProcEvent{
+				{Type: ebpf.ProcExec, Pid: 10, Ppid: 1, Comm: "ls", Exe: "/bin/ls", StartTime: 100},
+			},
+			seen:     []Proc{{Pid: 10, Ppid: 1, Comm: "bash", StartTime: 100}},
+			seenLast: true,
+			want: map[Pid]Proc{
+				10: {Pid: 10, Ppid: 1, Comm: "ls", Exe: "/bin/ls", StartTime: 100},
+			},
+			wantCounts: Counts{Execs: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := New(true)
+			if !tt.seenLast {
+				for _, p := range tt.seen {
+					table.Seen(p)
+				}
+			}
+			for _, ev := range tt.events {
+				table.Apply(ev)
+			}
+			if tt.seenLast {
+				for _, p := range tt.seen {
+					table.Seen(p)
+				}
+			}
+			if diff := cmp.Diff(tt.want, table.procs); diff != "" {
+				t.Errorf("Apply() diff: %v", diff)
+			}
+			if diff := cmp.Diff(tt.wantCounts, table.TakeCounts()); diff != "" {
+				t.Errorf("TakeCounts() diff: %v", diff)
+			}
+			if got := table.TakeCounts(); got != (Counts{}) {
+				t.Errorf("TakeCounts() after take got: %v", got)
+			}
+			var wantExits []ebpf.ProcEvent
+			for _, ev := range tt.events {
+				if ev.Type == ebpf.ProcExit {
+					wantExits = append(wantExits, ev)
+				}
+			}
+			if diff := cmp.Diff(wantExits, table.TakeExits()); diff != "" {
+				t.Errorf("TakeExits() diff: %v", diff)
+			}
+		})
+	}
+}
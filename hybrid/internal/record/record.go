@@ -0,0 +1,127 @@
+package record
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// Version of the recording format
+const Version = 1
+
+// Header is written once at the start of a recording
+type Header struct {
+	Version      int
+	Tool         string
+	NumCPU       int
+	IsolatedCPUs []CPUId
+	Interval     time.Duration
+	// Strategy used to read the cpu time of active processes, empty for
+	// recordings made before there was a choice
+	Strategy string
+}
+
+// Tick holds the raw inputs of one collection interval
+type Tick struct {
+	Time time.Time
+	// ActiveProcs as drained from ebpf, empty for a full /proc scan
+	ActiveProcs ebpf.ActiveProcs
+	// Pids listed in /proc, empty unless the tick did a full /proc scan
+	Pids []Pid
+	// CpuStat is the content of /proc/stat
+	CpuStat []byte
+	// PidStats is the content of /proc/<pid>/stat for every pid read
+	// successfully. Failed reads are not recorded.
+	PidStats map[Pid][]byte
+	// PidCgroups is the content of /proc/<pid>/cgroup for every pid read
+	// successfully, empty for recordings made before units were read
+	PidCgroups map[Pid][]byte
+	// ProcTimes read in the kernel by the task-iter strategy
+	ProcTimes []ebpf.ProcTimes
+}
+
+// Writer writes a gzip compressed stream of gob encoded ticks
+type Writer struct {
+	f   *os.File
+	zw  *gzip.Writer
+	enc *gob.Encoder
+}
+
+func Create(path string, hdr Header) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create recording: %w", err)
+	}
+	zw := gzip.NewWriter(f)
+	w := &Writer{f: f, zw: zw, enc: gob.NewEncoder(zw)}
+	hdr.Version = Version
+	if err := w.enc.Encode(&hdr); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("cannot write recording header: %w", err)
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(tick *Tick) error {
+	if err := w.enc.Encode(tick); err != nil {
+		return fmt.Errorf("cannot write tick: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	return errors.Join(w.zw.Close(), w.f.Close())
+}
+
+// Reader reads a recording created by Writer
+type Reader struct {
+	f   *os.File
+	zr  *gzip.Reader
+	dec *gob.Decoder
+}
+
+func Open(path string) (*Reader, Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Header{}, fmt.Errorf("cannot open recording: %w", err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, Header{}, fmt.Errorf("invalid recording %s: %w", path, err)
+	}
+	r := &Reader{f: f, zr: zr, dec: gob.NewDecoder(zr)}
+	var hdr Header
+	if err := r.dec.Decode(&hdr); err != nil {
+		r.Close()
+		return nil, Header{}, fmt.Errorf("cannot read recording header: %w", err)
+	}
+	if hdr.Version != Version {
+		r.Close()
+		return nil, Header{}, fmt.Errorf("unsupported recording version %d", hdr.Version)
+	}
+	return r, hdr, nil
+}
+
+// Next returns the next tick, or io.EOF at the end of the recording
+func (r *Reader) Next() (*Tick, error) {
+	var tick Tick
+	if err := r.dec.Decode(&tick); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("cannot read tick: %w", err)
+	}
+	return &tick, nil
+}
+
+func (r *Reader) Close() error {
+	return errors.Join(r.zr.Close(), r.f.Close())
+}
@@ -0,0 +1,110 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+type fakeSource struct {
+	procs   ebpf.ActiveProcs
+	stats   map[Pid][]byte
+	cgroups map[Pid][]byte
+	times   []ebpf.ProcTimes
+}
+
+func (s *fakeSource) ActiveProcs() (ebpf.ActiveProcs, error) { return s.procs, nil }
+func (s *fakeSource) Pids() ([]Pid, error)                   { return nil, nil }
+func (s *fakeSource) CpuStat() ([]byte, error)               { return []byte("cpu 1 2 3"), nil }
+func (s *fakeSource) PidStat(pid Pid) ([]byte, error) {
+	data, ok := s.stats[pid]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+func (s *fakeSource) PidCgroup(pid Pid) ([]byte, error) {
+	data, ok := s.cgroups[pid]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+func (s *fakeSource) ProcTimes(pids []Pid) ([]ebpf.ProcTimes, error) { return s.times, nil }
+
+func Test_RecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.gz")
+	hdr := Header{Tool: "test", NumCPU: 4, IsolatedCPUs: []CPUId{3}, Interval: time.Second, Strategy: "task-iter"}
+	w, err := Create(path, hdr)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	src := &fakeSource{
+		procs:   ebpf.ActiveProcs{{Pid: 10, Cpu: 1, Comm: "a"}, {Pid: 11, Cpu: 3, Comm: "b"}},
+		stats:   map[Pid][]byte{10: []byte("10 (a) S 1")},
+		cgroups: map[Pid][]byte{11: []byte("0::/system.slice/b.service\n")},
+		times:   []ebpf.ProcTimes{{Pid: 11, Ppid: 1, Comm: "b", State: 'R', Cpu: 3, Utime: 2e9, Stime: 1e9, StartTime: 5e9}},
+	}
+	rec := NewRecorder(src, w)
+	ts := time.Unix(1000, 0)
+	rec.ActiveProcs()
+	rec.CpuStat()
+	rec.PidStat(10)
+	rec.PidStat(11)
+	rec.PidCgroup(10)
+	rec.PidCgroup(11)
+	rec.ProcTimes([]Pid{11})
+	if err := rec.Commit(ts); err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r, gotHdr, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+	hdr.Version = Version
+	if !cmp.Equal(gotHdr, hdr) {
+		t.Errorf("header diff: %v", cmp.Diff(gotHdr, hdr))
+	}
+	replayer := NewReplayer(r)
+	gotTs, err := replayer.Next()
+	if err != nil {
+		t.Fatalf("Next() failed: %v", err)
+	}
+	if !gotTs.Equal(ts) {
+		t.Errorf("Next() got: %v, want: %v", gotTs, ts)
+	}
+	procs, _ := replayer.ActiveProcs()
+	if !cmp.Equal(procs, src.procs) {
+		t.Errorf("ActiveProcs() diff: %v", cmp.Diff(procs, src.procs))
+	}
+	if data, err := replayer.PidStat(10); err != nil || string(data) != "10 (a) S 1" {
+		t.Errorf("PidStat(10) got: %q, %v", data, err)
+	}
+	if _, err := replayer.PidStat(11); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("PidStat(11) got: %v, want: %v", err, fs.ErrNotExist)
+	}
+	if data, err := replayer.PidCgroup(11); err != nil || string(data) != "0::/system.slice/b.service\n" {
+		t.Errorf("PidCgroup(11) got: %q, %v", data, err)
+	}
+	if _, err := replayer.PidCgroup(10); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("PidCgroup(10) got: %v, want: %v", err, fs.ErrNotExist)
+	}
+	if times, _ := replayer.ProcTimes([]Pid{11}); !cmp.Equal(times, src.times) {
+		t.Errorf("ProcTimes() diff: %v", cmp.Diff(times, src.times))
+	}
+	if _, err := replayer.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() got: %v, want: %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,198 @@
+package record
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+)
+
+// Source provides the raw inputs of a collection tick
+type Source interface {
+	ActiveProcs() (ebpf.ActiveProcs, error)
+	Pids() ([]Pid, error)
+	CpuStat() ([]byte, error)
+	PidStat(pid Pid) ([]byte, error)
+	PidCgroup(pid Pid) ([]byte, error)
+	// ProcTimes returns the cpu times of pids read in the kernel, without
+	// the processes which exited
+	ProcTimes(pids []Pid) ([]ebpf.ProcTimes, error)
+}
+
+type activeProcsGetter interface {
+	GetActiveProcs() (ebpf.ActiveProcs, error)
+}
+
+// ProcTimesFunc reads the cpu times of pids in the kernel
+type ProcTimesFunc func(pids []Pid) ([]ebpf.ProcTimes, error)
+
+// liveSource reads from ebpf and /proc, only from /proc if bpf is nil
+type liveSource struct {
+	bpf       activeProcsGetter
+	procTimes ProcTimesFunc
+}
+
+func Live(bpf activeProcsGetter, procTimes ProcTimesFunc) Source {
+	return &liveSource{bpf: bpf, procTimes: procTimes}
+}
+
+func (s *liveSource) ActiveProcs() (ebpf.ActiveProcs, error) {
+	if s.bpf == nil {
+		return nil, fmt.Errorf("no ebpf to read active procs from")
+	}
+	return s.bpf.GetActiveProcs()
+}
+
+func (s *liveSource) Pids() ([]Pid, error) {
+	return proc.GetProcPids()
+}
+
+func (s *liveSource) CpuStat() ([]byte, error) {
+	return proc.ReadCpuStatBytes()
+}
+
+func (s *liveSource) PidStat(pid Pid) ([]byte, error) {
+	return proc.ReadPidStatBytes(pid)
+}
+
+func (s *liveSource) PidCgroup(pid Pid) ([]byte, error) {
+	return proc.ReadPidCgroupBytes(pid)
+}
+
+func (s *liveSource) ProcTimes(pids []Pid) ([]ebpf.ProcTimes, error) {
+	if s.procTimes == nil {
+		return nil, fmt.Errorf("no ebpf to read cpu times from")
+	}
+	return s.procTimes(pids)
+}
+
+// Recorder passes through another Source, saving everything read in a tick
+type Recorder struct {
+	src  Source
+	w    *Writer
+	tick Tick
+}
+
+func NewRecorder(src Source, w *Writer) *Recorder {
+	r := &Recorder{src: src, w: w}
+	r.reset()
+	return r
+}
+
+func (r *Recorder) reset() {
+	r.tick = Tick{PidStats: map[Pid][]byte{}, PidCgroups: map[Pid][]byte{}}
+}
+
+func (r *Recorder) ActiveProcs() (ebpf.ActiveProcs, error) {
+	procs, err := r.src.ActiveProcs()
+	if err == nil {
+		r.tick.ActiveProcs = append(r.tick.ActiveProcs, procs...)
+	}
+	return procs, err
+}
+
+func (r *Recorder) Pids() ([]Pid, error) {
+	pids, err := r.src.Pids()
+	if err == nil {
+		r.tick.Pids = pids
+	}
+	return pids, err
+}
+
+func (r *Recorder) CpuStat() ([]byte, error) {
+	data, err := r.src.CpuStat()
+	if err == nil {
+		r.tick.CpuStat = data
+	}
+	return data, err
+}
+
+func (r *Recorder) PidStat(pid Pid) ([]byte, error) {
+	data, err := r.src.PidStat(pid)
+	if err == nil {
+		r.tick.PidStats[pid] = data
+	}
+	return data, err
+}
+
+func (r *Recorder) PidCgroup(pid Pid) ([]byte, error) {
+	data, err := r.src.PidCgroup(pid)
+	if err == nil {
+		r.tick.PidCgroups[pid] = data
+	}
+	return data, err
+}
+
+func (r *Recorder) ProcTimes(pids []Pid) ([]ebpf.ProcTimes, error) {
+	times, err := r.src.ProcTimes(pids)
+	if err == nil {
+		r.tick.ProcTimes = append(r.tick.ProcTimes, times...)
+	}
+	return times, err
+}
+
+// Commit writes the inputs read since the previous Commit as the tick at ts
+func (r *Recorder) Commit(ts time.Time) error {
+	r.tick.Time = ts
+	err := r.w.Write(&r.tick)
+	r.reset()
+	return err
+}
+
+// Replayer is a Source returning the inputs of recorded ticks
+type Replayer struct {
+	r    *Reader
+	tick *Tick
+}
+
+func NewReplayer(r *Reader) *Replayer {
+	return &Replayer{r: r, tick: &Tick{}}
+}
+
+// Next moves to the next recorded tick and returns its time, or io.EOF
+func (r *Replayer) Next() (time.Time, error) {
+	tick, err := r.r.Next()
+	if err != nil {
+		return time.Time{}, err
+	}
+	r.tick = tick
+	return tick.Time, nil
+}
+
+func (r *Replayer) ActiveProcs() (ebpf.ActiveProcs, error) {
+	return r.tick.ActiveProcs, nil
+}
+
+func (r *Replayer) Pids() ([]Pid, error) {
+	return r.tick.Pids, nil
+}
+
+func (r *Replayer) CpuStat() ([]byte, error) {
+	if r.tick.CpuStat == nil {
+		return nil, fmt.Errorf("/proc/stat not recorded: %w", fs.ErrNotExist)
+	}
+	return r.tick.CpuStat, nil
+}
+
+func (r *Replayer) PidStat(pid Pid) ([]byte, error) {
+	data, ok := r.tick.PidStats[pid]
+	if !ok {
+		return nil, fmt.Errorf("/proc/%d/stat not recorded: %w", pid, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (r *Replayer) PidCgroup(pid Pid) ([]byte, error) {
+	data, ok := r.tick.PidCgroups[pid]
+	if !ok {
+		return nil, fmt.Errorf("/proc/%d/cgroup not recorded: %w", pid, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (r *Replayer) ProcTimes(pids []Pid) ([]ebpf.ProcTimes, error) {
+	return r.tick.ProcTimes, nil
+}
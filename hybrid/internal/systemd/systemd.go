@@ -0,0 +1,185 @@
+package systemd
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+// rootSlice is the slice of the processes in the root cgroup, as kernel
+// threads
+const rootSlice = "-.slice"
+
+// unknown labels the processes whose cgroup could not be read
+const unknown = "(unknown)"
+
+// unitSuffixes are the types of the units which have processes
+var unitSuffixes = []string{".service", ".scope", ".socket", ".mount", ".swap"}
+
+// Unit is the systemd unit of a process and the slice it is in
+type Unit struct {
+	// Name is empty for a process in a slice but in no unit, or in a
+	// cgroup systemd does not manage
+	Name  string `json:"unit,omitempty"`
+	Slice string `json:"slice,omitempty"`
+}
+
+// String returns the label of u: its name, else its slice
+func (u Unit) String() string {
+	switch {
+	case u.Name != "":
+		return u.Name
+	case u.Slice != "":
+		return u.Slice
+	}
+	return unknown
+}
+
+/*
+FromCgroup returns the unit of a cgroup path, as systemd does: the first
+component below the slices is the unit, the last slice above it is its
+slice. A process of a user service is accounted to the user manager,
+user@<uid>.service, as /user.slice/user-1000.slice/user@1000.service/app.slice/x.service
+*/
+func FromCgroup(path string) Unit {
+	u := Unit{Slice: rootSlice}
+	for _, c := range strings.Split(strings.Trim(path, "/"), "/") {
+		// systemd escapes the names which would clash with cgroupfs files
+		name := strings.TrimPrefix(c, "_")
+		if strings.HasSuffix(name, ".slice") {
+			u.Slice = name
+			continue
+		}
+		if slices.ContainsFunc(unitSuffixes, func(s string) bool { return strings.HasSuffix(name, s) }) {
+			u.Name = name
+		}
+		break
+	}
+	return u
+}
+
+// ParseUnit returns the unit of the content of /proc/<pid>/cgroup
+func ParseUnit(data string) (Unit, error) {
+	path, err := proc.ParseCgroupPath(data)
+	if err != nil {
+		return Unit{}, err
+	}
+	return FromCgroup(path), nil
+}
+
+type cached struct {
+	startTime proc.CpuTicks
+	unit      Unit
+}
+
+/*
+Resolver returns the unit of processes from /proc/<pid>/cgroup, read once
+per process: processes seldom move to another cgroup.
+*/
+type Resolver struct {
+	// read returns the content of /proc/<pid>/cgroup
+	read  func(Pid) ([]byte, error)
+	units map[Pid]cached
+}
+
+func NewResolver(read func(Pid) ([]byte, error)) *Resolver {
+	return &Resolver{read: read, units: map[Pid]cached{}}
+}
+
+// Get returns the unit of the process of stat, cached by pid and start time
+func (r *Resolver) Get(stat proc.PidStat) Unit {
+	if c, ok := r.units[stat.Pid]; ok && c.startTime == stat.StartTime {
+		return c.unit
+	}
+	u, ok := r.readUnit(stat.Pid)
+	if ok {
+		r.units[stat.Pid] = cached{startTime: stat.StartTime, unit: u}
+	}
+	return u
+}
+
+// Of returns the cached unit of pid whatever its start time, else the unit
+// read, not cached
+func (r *Resolver) Of(pid Pid) Unit {
+	if c, ok := r.units[pid]; ok {
+		return c.unit
+	}
+	u, _ := r.readUnit(pid)
+	return u
+}
+
+// Exited returns the unit of the exited process of stat and forgets it. The
+// unit of a process which was not read is the one of its parent, which it
+// was forked in.
+func (r *Resolver) Exited(stat proc.PidStat) Unit {
+	if c, ok := r.units[stat.Pid]; ok && c.startTime == stat.StartTime {
+		delete(r.units, stat.Pid)
+		return c.unit
+	}
+	return r.Of(stat.Ppid)
+}
+
+// Forget drops the unit of an exited process
+func (r *Resolver) Forget(pid Pid) {
+	delete(r.units, pid)
+}
+
+func (r *Resolver) readUnit(pid Pid) (Unit, bool) {
+	data, err := r.read(pid)
+	if err != nil {
+		return Unit{}, false
+	}
+	u, err := ParseUnit(string(data))
+	if err != nil {
+		return Unit{}, false
+	}
+	return u, true
+}
+
+// Usage is the cpu time of the processes of a unit in an interval
+type Usage struct {
+	Unit
+	Ticks proc.CpuTicks
+	Procs int
+	// ExitedTicks is the part of Ticks used by the processes which exited
+	// in the interval
+	ExitedTicks proc.CpuTicks
+	Exited      int
+}
+
+// Aggregate returns the cpu time of deltas and exited, the deltas of the
+// processes which exited, by unit, the highest first
+func Aggregate(r *Resolver, deltas, exited []usage.Delta) []Usage {
+	byUnit := map[Unit]*Usage{}
+	add := func(u Unit, d usage.Delta) *Usage {
+		uu, ok := byUnit[u]
+		if !ok {
+			uu = &Usage{Unit: u}
+			byUnit[u] = uu
+		}
+		uu.Ticks += d.Ticks
+		uu.Procs++
+		return uu
+	}
+	// the exited first, a pid reused in the interval replaces their unit
+	for _, d := range exited {
+		uu := add(r.Exited(d.PidStat), d)
+		uu.ExitedTicks += d.Ticks
+		uu.Exited++
+	}
+	for _, d := range deltas {
+		add(r.Get(d.PidStat), d)
+	}
+	usages := make([]Usage, 0, len(byUnit))
+	for _, uu := range byUnit {
+		usages = append(usages, *uu)
+	}
+	slices.SortFunc(usages, func(a, b Usage) int {
+		return cmp.Or(cmp.Compare(b.Ticks, a.Ticks), cmp.Compare(a.String(), b.String()), cmp.Compare(a.Slice, b.Slice))
+	})
+	return usages
+}
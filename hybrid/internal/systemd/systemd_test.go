@@ -0,0 +1,131 @@
+package systemd
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+func Test_FromCgroup(t *testing.T) {
+	tests := []struct {
+		path string
+		want Unit
+	}{
+		{path: "/system.slice/sshd.service", want: Unit{Name: "sshd.service", Slice: "system.slice"}},
+		{path: "/system.slice/system-getty.slice/getty@tty1.service", want: Unit{Name: "getty@tty1.service", Slice: "system-getty.slice"}},
+		{path: "/user.slice/user-1000.slice/session-2.scope", want: Unit{Name: "session-2.scope", Slice: "user-1000.slice"}},
+		{path: "/user.slice/user-1000.slice/user@1000.service/app.slice/pipewire.service", want: Unit{Name: "user@1000.service", Slice: "user-1000.slice"}},
+		{path: "/init.scope", want: Unit{Name: "init.scope", Slice: "-.slice"}},
+		{path: "/system.slice/_dev-mqueue.mount", want: Unit{Name: "dev-mqueue.mount", Slice: "system.slice"}},
+		{path: "/machine.slice", want: Unit{Slice: "machine.slice"}},
+		{path: "/", want: Unit{Slice: "-.slice"}},
+		{path: "/docker/0123abcd", want: Unit{Slice: "-.slice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, FromCgroup(tt.path)); diff != "" {
+				t.Errorf("FromCgroup() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func Test_String(t *testing.T) {
+	tests := []struct {
+		unit Unit
+		want string
+	}{
+		{unit: Unit{Name: "sshd.service", Slice: "system.slice"}, want: "sshd.service"},
+		{unit: Unit{Slice: "-.slice"}, want: "-.slice"},
+		{unit: Unit{}, want: "(unknown)"},
+	}
+	for _, tt := range tests {
+		if got := tt.unit.String(); got != tt.want {
+			t.Errorf("String() got: %v, want: %v", got, tt.want)
+		}
+	}
+}
+
+// fakeCgroups returns a cgroup read func of the cgroup paths of processes,
+// and the number of reads
+func fakeCgroups(paths map[Pid]string) (func(Pid) ([]byte, error), *int) {
+	reads := 0
+	return func(pid Pid) ([]byte, error) {
+		reads++
+		path, ok := paths[pid]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return []byte("0::" + path + "\n"), nil
+	}, &reads
+}
+
+func Test_Resolver(t *testing.T) {
+	paths := map[Pid]string{
+		10: "/system.slice/a.service",
+		20: "/system.slice/b.service",
+	}
+	read, reads := fakeCgroups(paths)
+	r := NewResolver(read)
+	a := Unit{Name: "a.service", Slice: "system.slice"}
+	b := Unit{Name: "b.service", Slice: "system.slice"}
+
+	if diff := cmp.Diff(a, r.Get(proc.PidStat{Pid: 10, StartTime: 5})); diff != "" {
+		t.Errorf("Get() diff: %v", diff)
+	}
+	// cached while the process moves
+	paths[10] = "/system.slice/c.service"
+	r.Get(proc.PidStat{Pid: 10, StartTime: 5})
+	if diff := cmp.Diff(a, r.Of(10)); diff != "" {
+		t.Errorf("Of() diff: %v", diff)
+	}
+	if *reads != 1 {
+		t.Errorf("reads got: %v, want: 1", *reads)
+	}
+	// a process which exited is not cached
+	if diff := cmp.Diff(Unit{}, r.Get(proc.PidStat{Pid: 30, StartTime: 7})); diff != "" {
+		t.Errorf("Get() diff: %v", diff)
+	}
+	// the unit of an exited process which was read
+	if diff := cmp.Diff(a, r.Exited(proc.PidStat{Pid: 10, Ppid: 20, StartTime: 5})); diff != "" {
+		t.Errorf("Exited() diff: %v", diff)
+	}
+	// else the unit of its parent
+	if diff := cmp.Diff(b, r.Exited(proc.PidStat{Pid: 10, Ppid: 20, StartTime: 5})); diff != "" {
+		t.Errorf("Exited() diff: %v", diff)
+	}
+	// a reused pid is read again
+	if diff := cmp.Diff(Unit{Name: "c.service", Slice: "system.slice"}, r.Get(proc.PidStat{Pid: 10, StartTime: 9})); diff != "" {
+		t.Errorf("Get() diff: %v", diff)
+	}
+}
+
+func Test_Aggregate(t *testing.T) {
+	read, _ := fakeCgroups(map[Pid]string{
+		1:  "/init.scope",
+		10: "/system.slice/make.service",
+		11: "/system.slice/make.service",
+		2:  "/",
+		3:  "/",
+	})
+	r := NewResolver(read)
+	delta := func(pid, ppid Pid, ticks proc.CpuTicks) usage.Delta {
+		return usage.Delta{PidStat: proc.PidStat{Pid: pid, Ppid: ppid}, Ticks: ticks}
+	}
+	got := Aggregate(r,
+		[]usage.Delta{delta(1, 0, 1), delta(10, 1, 5), delta(11, 10, 3), delta(2, 0, 1), delta(3, 2, 1)},
+		// a compiler forked by make
+		[]usage.Delta{delta(12, 11, 20)})
+	want := []Usage{
+		{Unit: Unit{Name: "make.service", Slice: "system.slice"}, Ticks: 28, Procs: 3, ExitedTicks: 20, Exited: 1},
+		{Unit: Unit{Slice: "-.slice"}, Ticks: 2, Procs: 2},
+		{Unit: Unit{Name: "init.scope", Slice: "-.slice"}, Ticks: 1, Procs: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Aggregate() diff: %v", diff)
+	}
+}
@@ -0,0 +1,217 @@
+package tree
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+// RootKind is the ancestor processes are rolled up to
+type RootKind string
+
+const (
+	// RootSession is the session leader
+	RootSession RootKind = "session"
+	// RootUnit is the ancestor started by the service manager: the highest
+	// one below pid 1 or below a systemd user manager
+	RootUnit RootKind = "unit"
+	// RootComm is the highest ancestor with a given comm, the process
+	// included
+	RootComm RootKind = "comm"
+)
+
+// Roots tells which ancestor processes are rolled up to
+type Roots struct {
+	Kind RootKind
+	// Comm of the ancestor for RootComm
+	Comm string
+}
+
+// ParseRoots parses session, unit or comm=<name>
+func ParseRoots(s string) (Roots, error) {
+	switch kind, comm, _ := strings.Cut(s, "="); RootKind(kind) {
+	case RootSession, RootUnit:
+		if comm != "" {
+			return Roots{}, fmt.Errorf("%s roots take no comm", kind)
+		}
+		return Roots{Kind: RootKind(kind)}, nil
+	case RootComm:
+		if comm == "" {
+			return Roots{}, fmt.Errorf("comm roots need a name, as comm=make")
+		}
+		return Roots{Kind: RootComm, Comm: comm}, nil
+	}
+	return Roots{}, fmt.Errorf("unknown roots %q, want session, unit or comm=<name>", s)
+}
+
+func (r Roots) String() string {
+	if r.Kind == RootComm {
+		return string(r.Kind) + "=" + r.Comm
+	}
+	return string(r.Kind)
+}
+
+// Node is a process of the tree
+type Node struct {
+	Pid     Pid
+	Ppid    Pid
+	Session Pid
+	Comm    string
+}
+
+// Root is the ancestor a process is rolled up to. Pid 0 groups the
+// processes without one: kernel threads have no session, and no ancestor
+// of a process may have the comm of RootComm.
+type Root struct {
+	Pid  Pid
+	Comm string
+}
+
+// other is the root of the processes without one
+var other = Root{Comm: "(other)"}
+
+// maxDepth bounds the walk up a tree, pid reuse may make a loop
+const maxDepth = 128
+
+// systemdComm is the comm of the service managers, pid 1 and the user ones
+const systemdComm = "systemd"
+
+/*
+Tree resolves the roots of processes from their ppid. The nodes which were
+not added, the ancestors which did not run, are looked up once.
+*/
+type Tree struct {
+	nodes map[Pid]*Node
+	// lookup returns an ancestor, from the process table or /proc
+	lookup func(Pid) (Node, bool)
+}
+
+func New(lookup func(Pid) (Node, bool)) *Tree {
+	return &Tree{nodes: map[Pid]*Node{}, lookup: lookup}
+}
+
+// Add adds n, replacing the node of its pid
+func (t *Tree) Add(n Node) {
+	t.nodes[n.Pid] = &n
+}
+
+// node returns the node of pid, looked up if it was not added
+func (t *Tree) node(pid Pid) (Node, bool) {
+	n, ok := t.nodes[pid]
+	if !ok {
+		// a failed lookup is remembered as nil
+		if found, ok := t.lookup(pid); ok {
+			n = &found
+		}
+		t.nodes[pid] = n
+	}
+	if n == nil {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// ancestors returns the node of pid and its known ancestors, up to the top
+func (t *Tree) ancestors(pid Pid) []Node {
+	var chain []Node
+	for range maxDepth {
+		n, ok := t.node(pid)
+		if !ok || slices.ContainsFunc(chain, func(c Node) bool { return c.Pid == n.Pid }) {
+			break
+		}
+		chain = append(chain, n)
+		if n.Ppid == 0 {
+			break
+		}
+		pid = n.Ppid
+	}
+	return chain
+}
+
+// Root returns the ancestor of pid of roots
+func (t *Tree) Root(pid Pid, roots Roots) Root {
+	switch roots.Kind {
+	case RootSession:
+		n, ok := t.node(pid)
+		if !ok || n.Session == 0 {
+			return other
+		}
+		leader, _ := t.node(n.Session)
+		return Root{Pid: n.Session, Comm: leader.Comm}
+	case RootUnit:
+		chain := t.ancestors(pid)
+		for _, n := range chain {
+			if n.Ppid <= 1 {
+				return Root{Pid: n.Pid, Comm: n.Comm}
+			}
+			if parent, ok := t.node(n.Ppid); ok && parent.Comm == systemdComm {
+				return Root{Pid: n.Pid, Comm: n.Comm}
+			}
+		}
+		// the top is unknown, the highest known ancestor stands for it
+		if len(chain) > 0 {
+			top := chain[len(chain)-1]
+			return Root{Pid: top.Pid, Comm: top.Comm}
+		}
+	case RootComm:
+		chain := t.ancestors(pid)
+		for _, n := range slices.Backward(chain) {
+			if n.Comm == roots.Comm {
+				return Root{Pid: n.Pid, Comm: n.Comm}
+			}
+		}
+	}
+	return other
+}
+
+// RootUsage is the cpu time of the processes of a root in an interval
+type RootUsage struct {
+	Root
+	Ticks proc.CpuTicks
+	Procs int
+	// ExitedTicks is the part of Ticks used by the processes which exited
+	// in the interval
+	ExitedTicks proc.CpuTicks
+	Exited      int
+}
+
+/*
+RollUp returns the cpu time of deltas and exited, the deltas of the
+processes which exited, by root, the highest first. Every process must be
+added to t.
+*/
+func RollUp(t *Tree, roots Roots, deltas, exited []usage.Delta) []RootUsage {
+	byRoot := map[Root]*RootUsage{}
+	add := func(d usage.Delta) *RootUsage {
+		root := t.Root(d.Pid, roots)
+		u, ok := byRoot[root]
+		if !ok {
+			u = &RootUsage{Root: root}
+			byRoot[root] = u
+		}
+		u.Ticks += d.Ticks
+		u.Procs++
+		return u
+	}
+	for _, d := range deltas {
+		add(d)
+	}
+	for _, d := range exited {
+		u := add(d)
+		u.ExitedTicks += d.Ticks
+		u.Exited++
+	}
+	usages := make([]RootUsage, 0, len(byRoot))
+	for _, u := range byRoot {
+		usages = append(usages, *u)
+	}
+	slices.SortFunc(usages, func(a, b RootUsage) int {
+		return cmp.Or(cmp.Compare(b.Ticks, a.Ticks), cmp.Compare(a.Pid, b.Pid))
+	})
+	return usages
+}
@@ -0,0 +1,156 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/usage"
+)
+
+/*
+testTree is
+
+	1 systemd
+	├── 100 sshd
+	│   └── 200 bash (session 200)
+	│       └── 300 make
+	│           └── 301 make
+	│               └── 302 cc1
+	└── 500 systemd (user manager)
+	    └── 501 pipewire
+	2 kthreadd
+	└── 3 kworker
+*/
+var testNodes = []Node{
+	{Pid: 1, Ppid: 0, Session: 1, Comm: "systemd"},
+	{Pid: 100, Ppid: 1, Session: 100, Comm: "sshd"},
+	{Pid: 200, Ppid: 100, Session: 200, Comm: "bash"},
+	{Pid: 300, Ppid: 200, Session: 200, Comm: "make"},
+	{Pid: 301, Ppid: 300, Session: 200, Comm: "make"},
+	{Pid: 302, Ppid: 301, Session: 200, Comm: "cc1"},
+	{Pid: 500, Ppid: 1, Session: 500, Comm: "systemd"},
+	{Pid: 501, Ppid: 500, Session: 501, Comm: "pipewire"},
+	{Pid: 2, Ppid: 0, Comm: "kthreadd"},
+	{Pid: 3, Ppid: 2, Comm: "kworker"},
+}
+
+// testTree adds the nodes of added, the others are looked up
+func testTree(added ...Pid) (*Tree, *int) {
+	lookups := 0
+	t := New(func(pid Pid) (Node, bool) {
+		lookups++
+		for _, n := range testNodes {
+			if n.Pid == pid {
+				return n, true
+			}
+		}
+		return Node{}, false
+	})
+	for _, n := range testNodes {
+		for _, pid := range added {
+			if n.Pid == pid {
+				t.Add(n)
+			}
+		}
+	}
+	return t, &lookups
+}
+
+func Test_ParseRoots(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Roots
+		wantErr bool
+	}{
+		{in: "session", want: Roots{Kind: RootSession}},
+		{in: "unit", want: Roots{Kind: RootUnit}},
+		{in: "comm=make", want: Roots{Kind: RootComm, Comm: "make"}},
+		{in: "comm", wantErr: true},
+		{in: "unit=x", wantErr: true},
+		{in: "cgroup", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRoots(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRoots() error: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseRoots() diff: %v", diff)
+			}
+			if err == nil && got.String() != tt.in {
+				t.Errorf("String() got: %v, want: %v", got.String(), tt.in)
+			}
+		})
+	}
+}
+
+func Test_Root(t *testing.T) {
+	tests := []struct {
+		name  string
+		pid   Pid
+		roots Roots
+		want  Root
+	}{
+		{name: "session leader", pid: 302, roots: Roots{Kind: RootSession}, want: Root{Pid: 200, Comm: "bash"}},
+		{name: "kernel thread has no session", pid: 3, roots: Roots{Kind: RootSession}, want: other},
+		{name: "unit below pid 1", pid: 302, roots: Roots{Kind: RootUnit}, want: Root{Pid: 100, Comm: "sshd"}},
+		{name: "unit below a user manager", pid: 501, roots: Roots{Kind: RootUnit}, want: Root{Pid: 501, Comm: "pipewire"}},
+		{name: "unit of pid 1", pid: 1, roots: Roots{Kind: RootUnit}, want: Root{Pid: 1, Comm: "systemd"}},
+		{name: "unit of a kernel thread", pid: 3, roots: Roots{Kind: RootUnit}, want: Root{Pid: 2, Comm: "kthreadd"}},
+		{name: "highest comm", pid: 302, roots: Roots{Kind: RootComm, Comm: "make"}, want: Root{Pid: 300, Comm: "make"}},
+		{name: "comm of the process", pid: 300, roots: Roots{Kind: RootComm, Comm: "make"}, want: Root{Pid: 300, Comm: "make"}},
+		{name: "no comm", pid: 501, roots: Roots{Kind: RootComm, Comm: "make"}, want: other},
+		{name: "unknown process", pid: 999, roots: Roots{Kind: RootUnit}, want: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, _ := testTree(tt.pid)
+			if diff := cmp.Diff(tt.want, tree.Root(tt.pid, tt.roots)); diff != "" {
+				t.Errorf("Root() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func Test_Root_unknownAncestor(t *testing.T) {
+	// 301 exited, its child is rolled up to the highest known ancestor
+	tree := New(func(Pid) (Node, bool) { return Node{}, false })
+	tree.Add(Node{Pid: 302, Ppid: 301, Session: 200, Comm: "cc1"})
+	if diff := cmp.Diff(Root{Pid: 302, Comm: "cc1"}, tree.Root(302, Roots{Kind: RootUnit})); diff != "" {
+		t.Errorf("Root() diff: %v", diff)
+	}
+}
+
+func Test_lookupOnce(t *testing.T) {
+	tree, lookups := testTree(302)
+	tree.Root(302, Roots{Kind: RootUnit})
+	tree.Root(302, Roots{Kind: RootComm, Comm: "make"})
+	tree.Root(999, Roots{Kind: RootUnit})
+	tree.Root(999, Roots{Kind: RootUnit})
+	// 301, 300, 200, 100, 1 and 999
+	if *lookups != 6 {
+		t.Errorf("lookups got: %v, want: 6", *lookups)
+	}
+}
+
+func Test_RollUp(t *testing.T) {
+	tree, _ := testTree(302, 501)
+	delta := func(pid Pid, ticks proc.CpuTicks) usage.Delta {
+		return usage.Delta{PidStat: proc.PidStat{Pid: pid}, Ticks: ticks}
+	}
+	// a compiler which exited in the interval
+	tree.Add(Node{Pid: 303, Ppid: 301, Session: 200, Comm: "cc1"})
+	got := RollUp(tree, Roots{Kind: RootComm, Comm: "make"},
+		[]usage.Delta{delta(302, 10), delta(501, 5)},
+		[]usage.Delta{delta(303, 7)})
+	want := []RootUsage{
+		{Root: Root{Pid: 300, Comm: "make"}, Ticks: 17, Procs: 2, ExitedTicks: 7, Exited: 1},
+		{Root: other, Ticks: 5, Procs: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RollUp() diff: %v", diff)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -14,23 +16,64 @@ import (
 
 	"github.com/alecthomas/kingpin"
 	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
-	"github.com/vimalk78/ebpf-proc-hybrid/internal/isolated"
-	"github.com/vimalk78/ebpf-proc-hybrid/internal/proc"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/tree"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
 )
 
-var (
-	bpfInstance = ebpf.MustInstance()
-
-	isolatedCPUs = proc.MustGetIsolatedCPUs()
+const toolName = "ebpf-proc-hybrid"
 
-	app          = kingpin.New("ebpf-proc-hybrid", "an ebpf + /proc hybrid approach to get procsess cpu usage")
+var (
+	app          = kingpin.New(toolName, "an ebpf + /proc hybrid approach to get procsess cpu usage")
 	loopInterval = app.Flag("loop-interval", "loop interval").Default("1000ms").Duration()
 	enablePprof  = app.Flag("enable-pprof", "enable profiling with pprof").Default("false").Bool()
 	onlyIsolated = app.Flag("only-isolated", "check only isolated cpus").Default("false").Bool()
+	recordFile   = app.Flag("record", "record the raw inputs of every tick to a file").String()
+	replayFile   = app.Flag("replay", "replay a recording instead of reading ebpf and /proc").ExistingFile()
+	strategy     = app.Flag("strategy", "how to read the cpu time of active processes: proc reads /proc/<pid>/stat, task-iter runs a bpf task iterator over them, syscall looks them up with a bpf syscall program, allproc reads /proc/<pid>/stat of every process without ebpf, auto picks the cheapest the kernel supports").Default(strategyProc).Enum(strategyProc, strategyTaskIter, strategySyscall, strategyAllProc, strategyAuto)
+	activeMap    = app.Flag("active-procs-map", "map type of active_procs: hash is shared by all cpus, percpu-hash and lru-percpu-hash have a value per cpu and record every cpu a process ran on").Default(string(ebpf.ActiveProcsHash)).Enum(string(ebpf.ActiveProcsHash), string(ebpf.ActiveProcsPerCPUHash), string(ebpf.ActiveProcsLRUPerCPUHash))
+	offCPU       = app.Flag("off-cpu", "also measure the time active processes spend off cpu, sleeping, in uninterruptible sleep (IO) or preempted, needs sched_switch attached as tp_btf").Default("false").Bool()
+	procEvents   = app.Flag("proc-events", "keep a table of the live processes from their fork, exec and exit events instead of scanning /proc, needs kernel BTF and tp_btf").Default("false").Bool()
+	systemdUnits = app.Flag("units", "map every active process to its systemd unit and slice from /proc/<pid>/cgroup, read once per process, aggregate the cpu usage of run per unit, and label the processes of every output with their unit").Default("false").Bool()
+	pinName      = app.Flag("pin", "pin active_procs and the sched_switch link under /sys/fs/bpf/<name>, and reuse them on restart").String()
+
+	enableBpfStats = app.Flag("bpf-stats", "enable kernel bpf stats and report the ebpf program overhead every loop interval").Default("false").Bool()
+
+	runCmd       = app.Command("run", "print the cpu usage of active processes every loop interval").Default()
+	runOffCPU    = runCmd.Flag("off-cpu-top", "number of processes with the most off-cpu time printed every loop interval with --off-cpu").Default("5").Int()
+	runRollup    = runCmd.Flag("rollup", "also print the cpu usage rolled up to ancestors: session (the session leader), unit (the ancestor started by systemd) or comm=<name> (the highest ancestor named name), with --proc-events it includes the processes which exited").String()
+	runRollupTop = runCmd.Flag("rollup-top", "number of roots printed every loop interval with --rollup").Default("10").Int()
+	runUnitsTop  = runCmd.Flag("units-top", "number of units printed every loop interval with --units").Default("10").Int()
+
+	probeCmd = app.Command("probe", "print the kernel features the strategies need, and the strategies available")
+
+	compareCmd    = app.Command("compare", "measure what hybrid misses against a full /proc scan on the same ticks")
+	compareTicks  = compareCmd.Flag("ticks", "number of ticks to compare, 0 to run until Ctrl-C").Default("0").Int()
+	compareReport = compareCmd.Flag("report", "markdown report file").Default("accuracy.md").String()
+	compareTop    = compareCmd.Flag("top", "number of top offenders in the report").Default("10").Int()
+
+	benchCmd   = app.Command("bench", "run a number of ticks and print statistics of the collection cost")
+	benchTicks = benchCmd.Flag("ticks", "number of ticks to measure").Default("60").Int()
+	benchJSON  = benchCmd.Flag("json", "also write the result as JSON to this file").String()
+
+	eventsCmd = app.Command("events", "print the fork, exec and exit of every process as they happen")
+
+	runqlatCmd        = app.Command("runqlat", "print the time tasks waited on a run queue every loop interval, as log2 histograms, needs sched_switch attached as tp_btf")
+	runqlatPerCPU     = runqlatCmd.Flag("per-cpu", "also print a histogram per cpu").Default("false").Bool()
+	runqlatPerProcess = runqlatCmd.Flag("per-process", "also measure a histogram per process, and print the top ones").Default("false").Bool()
+	runqlatTop        = runqlatCmd.Flag("top", "number of processes printed with --per-process, the highest p99 first").Default("5").Int()
+	runqlatJSON       = runqlatCmd.Flag("json", "also append every interval as a JSON line to this file").String()
 )
 
 func main() {
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	compareCmd.Validate(nonNegative(map[string]*int{"top": compareTop}))
+	runqlatCmd.Validate(nonNegative(map[string]*int{"top": runqlatTop}))
+	runCmd.Validate(nonNegative(map[string]*int{"off-cpu-top": runOffCPU, "rollup-top": runRollupTop, "units-top": runUnitsTop}))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if cmd == probeCmd.FullCommand() {
+		printProbe(os.Stdout, ebpf.Probe())
+		return
+	}
 	// Subscribe to signals for terminating the program
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -38,77 +81,131 @@ func main() {
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-stopper
+		log.Info("received Ctrl-C.")
 		cancel()
 	}()
 	if *enablePprof {
 		setupPprof()
 	}
 
-	doneCh := make(chan struct{})
-	go run(ctx, doneCh)
-
-	<-ctx.Done()
-	log.Info("received Ctrl-C.")
-	<-doneCh
+	s, err := openSession(cmd)
+	if err != nil {
+		log.Error("cannot start", "error", err)
+		os.Exit(1)
+	}
+	switch cmd {
+	case runCmd.FullCommand():
+		err = run(ctx, s)
+	case compareCmd.FullCommand():
+		err = compare(ctx, s, *compareTicks, *compareReport, *compareTop)
+	case benchCmd.FullCommand():
+		err = runBench(ctx, s, *benchTicks, *benchJSON)
+	case eventsCmd.FullCommand():
+		err = printEvents(ctx, s)
+	case runqlatCmd.FullCommand():
+		err = runqlat(ctx, s, *runqlatPerCPU, *runqlatTop, *runqlatJSON)
+	}
 	log.Info("Shutting down...")
-	bpfInstance.Close()
+	s.Close()
+	if err != nil {
+		log.Error(cmd+" failed", "error", err)
+		os.Exit(1)
+	}
 }
 
-func run(ctx context.Context, doneCh chan struct{}) {
-	log.Info("Starting loop", "interval", loopInterval)
-	log.Info("Isolated CPUs", "num", len(isolatedCPUs), "cpus", isolatedCPUs)
-	isolated.Init(isolatedCPUs)
-	ticker := time.Tick(*loopInterval)
-	oldTs := time.Now()
-
-	for {
-		select {
-		case newTs := <-ticker:
-			timeDiffSec := newTs.Sub(oldTs).Seconds()
-			if timeDiffSec < 0.1 {
-				continue
-			}
-			procsRead := 0
-			// get active procs from ebpf
-			activeProcs, err := bpfInstance.GetActiveProcs()
-			if err != nil {
-				log.Error("Error reading active procs", "error", err)
-			}
-			// read /proc/<pid>/stat for each active proc
-			for _, activeProc := range activeProcs {
-				if slices.Contains(isolatedCPUs, activeProc.Cpu) {
-					isolated.StartTracking(activeProc.Cpu, activeProc)
-				} else {
-					if !*onlyIsolated {
-						// deliberately ignoring the returned values
-						_, _, _, err := proc.ReadPidProcStat(activeProc.Pid)
-						if err != nil {
-							log.Error("cannot read /proc/<pid>/stat", "proc", activeProc)
-						} else {
-							procsRead += 1
-						}
-					}
-				}
-			}
-			// get active procs from isolated cpus
-			isolatedActiveProcs := isolated.ActiveProcs()
-			for _, isolatedActiveProc := range isolatedActiveProcs {
-				// deliberately ignoring the returned values
-				_, _, _, err := proc.ReadPidProcStat(isolatedActiveProc.Pid)
-				if err != nil {
-					log.Error("cannot read /proc/<pid>/stat", "proc", isolatedActiveProc)
-					isolated.RemoveTracking(isolatedActiveProc.Pid)
-				} else {
-					procsRead += 1
-				}
-			}
-			log.Info("ActiveProcs", "num", procsRead, "cost", time.Since(newTs).String())
+func run(ctx context.Context, s *session) error {
+	c := newCollector(s.src, s.isolatedCPUs, s.strategy)
+	c.procs = s.procs
+	c.units = s.units
+	if *runRollup != "" {
+		roots, err := tree.ParseRoots(*runRollup)
+		if err != nil {
+			return fmt.Errorf("bad --rollup: %w", err)
+		}
+		c.roots = &roots
+	}
+	return s.loop(ctx, func(ts, startedAt time.Time) bool {
+		res := c.collect(ts)
+		attrs := []any{"num", res.procsRead, "cpu", res.cpuSeconds(), "host-cpu", res.hostCpuSeconds(), "switches", res.switches, "involuntary", res.involuntarySwitches, "cost", time.Since(startedAt).String()}
+		if s.procs != nil {
+			counts := s.procs.TakeCounts()
+			attrs = append(attrs, "procs-known", s.procs.Len(), "forks", counts.Forks, "execs", counts.Execs, "exits", counts.Exits)
+		}
+		if s.stats != nil {
+			attrs = append(attrs, s.stats.interval(ts)...)
+		}
+		if *offCPU {
+			attrs = append(attrs, "off-cpu-sleeping", res.offCPU.Sleeping.String(), "off-cpu-io", res.offCPU.Uninterruptible.String(), "off-cpu-preempted", res.offCPU.Preempted.String())
+		}
+		log.Info("ActiveProcs", attrs...)
+		if *offCPU {
+			logOffCPU(res, s.units, *runOffCPU)
+		}
+		if c.roots != nil {
+			logRollup(res, *c.roots, s.units, *runRollupTop)
+		}
+		if s.units != nil {
+			logUnits(res, *runUnitsTop)
+		}
+		return true
+	})
+}
 
-		case <-ctx.Done():
-			log.Info("loop finished...")
-			close(doneCh)
-			return
+// logOffCPU logs the top processes by time off cpu, with their cpu time, to
+// tell a process blocked (sleeping, io) from one starved (preempted)
+func logOffCPU(res tickResult, units *systemd.Resolver, top int) {
+	cpu := map[Pid]float64{}
+	for _, d := range res.deltas {
+		cpu[d.Pid] = ticksToSeconds(d.Ticks)
+	}
+	procs := slices.SortedFunc(slices.Values(res.offCPUProcs), func(a, b ebpf.ActiveProc) int {
+		return cmp.Compare(b.OffCPU.Total(), a.OffCPU.Total())
+	})
+	for _, p := range procs[:min(top, len(procs))] {
+		attrs := []any{"pid", p.Pid, "comm", p.Comm, "cpu", cpu[p.Pid],
+			"sleeping", p.OffCPU.Sleeping.String(), "io", p.OffCPU.Uninterruptible.String(), "preempted", p.OffCPU.Preempted.String()}
+		log.Info("Off CPU", append(attrs, unitAttrs(units, p.Pid)...)...)
+	}
+}
+
+// logRollup logs the top roots by cpu time, the exited descendants included
+func logRollup(res tickResult, roots tree.Roots, units *systemd.Resolver, top int) {
+	for _, u := range res.rollup[:min(top, len(res.rollup))] {
+		attrs := []any{"roots", roots.String(), "pid", u.Pid, "comm", u.Comm, "cpu", ticksToSeconds(u.Ticks),
+			"procs", u.Procs, "exited-cpu", ticksToSeconds(u.ExitedTicks), "exited", u.Exited}
+		if u.Pid != 0 {
+			attrs = append(attrs, unitAttrs(units, u.Pid)...)
+		}
+		log.Info("Rollup", attrs...)
+	}
+}
+
+// logUnits logs the top systemd units by cpu time, the exited processes
+// included
+func logUnits(res tickResult, top int) {
+	for _, u := range res.units[:min(top, len(res.units))] {
+		log.Info("Unit", "unit", u.String(), "slice", u.Slice, "cpu", ticksToSeconds(u.Ticks),
+			"procs", u.Procs, "exited-cpu", ticksToSeconds(u.ExitedTicks), "exited", u.Exited)
+	}
+}
+
+// unitAttrs returns the unit label of pid with --units, none without
+func unitAttrs(units *systemd.Resolver, pid Pid) []any {
+	if units == nil {
+		return nil
+	}
+	return []any{"unit", units.Of(pid).String()}
+}
+
+// nonNegative rejects a negative value of the int flags of a command, by name
+func nonNegative(flags map[string]*int) kingpin.CmdClauseValidator {
+	return func(*kingpin.CmdClause) error {
+		for name, v := range flags {
+			if *v < 0 {
+				return fmt.Errorf("--%s must not be negative, got %d", name, *v)
+			}
 		}
+		return nil
 	}
 }
 
@@ -30,59 +30,205 @@ const (
 	UserNiceSystem = User | Nice | System
 )
 
+// UserHZ is the unit of the tick counters in /proc/<pid>/stat and /proc/stat
+const UserHZ = 100
+
+// NsToTicks converts ns to UserHZ ticks, as the kernel does for /proc
+func NsToTicks(ns uint64) CpuTicks {
+	return CpuTicks(ns / (1e9 / UserHZ))
+}
+
+// PidStat holds the fields of /proc/<pid>/stat used for cpu usage
+type PidStat struct {
+	Pid       Pid
+	Comm      string
+	State     byte
+	Ppid      Pid
+	Session   Pid
+	Utime     CpuTicks
+	Stime     CpuTicks
+	StartTime CpuTicks // ticks after boot
+	Processor CPUId    // cpu last executed on
+}
+
+// Total returns utime + stime
+func (s PidStat) Total() CpuTicks {
+	return s.Utime + s.Stime
+}
+
 // Read /proc/<pid>/stat
 func ReadPidProcStat(pid Pid) (CpuTicks, CpuTicks, string, error) {
+	statBytes, err := ReadPidStatBytes(pid)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return readPidProcStatFromStr(pid, string(statBytes))
+}
+
+// ReadPidStatBytes returns the raw content of /proc/<pid>/stat
+func ReadPidStatBytes(pid Pid) ([]byte, error) {
 	statPath := fmt.Sprintf("/proc/%d/stat", pid)
 	statBytes, err := os.ReadFile(statPath)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("failed to read %s: %w", statPath, err)
+		return nil, fmt.Errorf("failed to read %s: %w", statPath, err)
 	}
-	return readPidProcStatFromStr(pid, string(statBytes))
+	return statBytes, nil
 }
 
 // Parse the stat file content
 func readPidProcStatFromStr(pid Pid, stats string) (CpuTicks, CpuTicks, string, error) {
+	stat, err := ParsePidStat(pid, stats)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return stat.Utime, stat.Stime, stat.Comm, nil
+}
+
+// ParsePidStat parses the content of /proc/<pid>/stat
+func ParsePidStat(pid Pid, stats string) (PidStat, error) {
 	// Handle processes with parentheses in names
 	// Format: pid (comm) state ppid ...
 	commStart := strings.IndexByte(stats, '(')
 	commEnd := strings.LastIndexByte(stats, ')')
 
 	if commStart == -1 || commEnd == -1 || commEnd < commStart {
-		return 0, 0, "", fmt.Errorf("invalid stat format for pid %d", pid)
+		return PidStat{}, fmt.Errorf("invalid stat format for pid %d", pid)
 	}
 
 	// Extract fields after the command name
 	fields := strings.Fields(stats[commEnd+1:])
 
 	// Fields 14 and 15 in the original file are utime and stime
-	// But they're at index 12 and 13 after splitting the trailing part
+	// But they're at index 11 and 12 after splitting the trailing part
 	if len(fields) < 14 {
-		return 0, 0, "", fmt.Errorf("not enough fields in stat for pid %d", pid)
+		return PidStat{}, fmt.Errorf("not enough fields in stat for pid %d", pid)
+	}
+
+	stat := PidStat{
+		Pid:   pid,
+		Comm:  stats[commStart+1 : commEnd],
+		State: fields[0][0],
+	}
+
+	ppid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return PidStat{}, fmt.Errorf("failed to parse ppid: %w", err)
 	}
+	stat.Ppid = Pid(ppid)
+
+	session, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return PidStat{}, fmt.Errorf("failed to parse session: %w", err)
+	}
+	stat.Session = Pid(session)
 
 	// Parse utime and stime
 	utime, err := strconv.ParseUint(fields[11], 10, 64)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("failed to parse utime: %w", err)
+		return PidStat{}, fmt.Errorf("failed to parse utime: %w", err)
 	}
+	stat.Utime = CpuTicks(utime)
 
 	stime, err := strconv.ParseUint(fields[12], 10, 64)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("failed to parse stime: %w", err)
+		return PidStat{}, fmt.Errorf("failed to parse stime: %w", err)
 	}
+	stat.Stime = CpuTicks(stime)
 
-	return CpuTicks(utime), CpuTicks(stime), stats[commStart+1 : commEnd], nil
+	// starttime (field 22) and processor (field 39) are present on all
+	// supported kernels, but truncated fixtures may not carry them
+	if len(fields) > 19 {
+		startTime, err := strconv.ParseUint(fields[19], 10, 64)
+		if err != nil {
+			return PidStat{}, fmt.Errorf("failed to parse starttime: %w", err)
+		}
+		stat.StartTime = CpuTicks(startTime)
+	}
+	if len(fields) > 36 {
+		processor, err := strconv.ParseInt(fields[36], 10, 32)
+		if err != nil {
+			return PidStat{}, fmt.Errorf("failed to parse processor: %w", err)
+		}
+		stat.Processor = CPUId(processor)
+	}
+
+	return stat, nil
 }
 
 /*
 ReadCpuStat returns
 */
 func ReadCpuStat(numCpu int, kind CpuTicksKind) ([]CpuTicks, error) {
+	data, err := ReadCpuStatBytes()
+	if err != nil {
+		return nil, err
+	}
+	return readCpuProcStatFromStr(numCpu, kind, string(data))
+}
+
+// ReadCpuStatBytes returns the raw content of /proc/stat
+func ReadCpuStatBytes() ([]byte, error) {
 	data, err := os.ReadFile("/proc/stat")
 	if err != nil {
 		return nil, fmt.Errorf("failed to read /proc/stat: %v", err)
 	}
-	return readCpuProcStatFromStr(numCpu, kind, string(data))
+	return data, nil
+}
+
+// ParseCpuStat parses the content of /proc/stat, see ReadCpuStat
+func ParseCpuStat(numCpu int, kind CpuTicksKind, data string) ([]CpuTicks, error) {
+	return readCpuProcStatFromStr(numCpu, kind, data)
+}
+
+// ParseBootTime returns the btime line of /proc/stat, in seconds since the epoch
+func ParseBootTime(data string) (uint64, error) {
+	for line := range strings.Lines(data) {
+		if after, ok := strings.CutPrefix(line, "btime "); ok {
+			btime, err := strconv.ParseUint(strings.TrimSpace(after), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid btime: %v", err)
+			}
+			return btime, nil
+		}
+	}
+	return 0, fmt.Errorf("btime not found")
+}
+
+// ReadPidCgroupBytes returns the raw content of /proc/<pid>/cgroup
+func ReadPidCgroupBytes(pid Pid) ([]byte, error) {
+	cgroupPath := fmt.Sprintf("/proc/%d/cgroup", pid)
+	data, err := os.ReadFile(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", cgroupPath, err)
+	}
+	return data, nil
+}
+
+/*
+ParseCgroupPath returns the cgroup path of the content of /proc/<pid>/cgroup
+in the hierarchy systemd manages: name=systemd of cgroup v1 when mounted, as
+in the hybrid layout, else the unified hierarchy of cgroup v2.
+*/
+func ParseCgroupPath(data string) (string, error) {
+	var unified string
+	found := false
+	for line := range strings.Lines(data) {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[1] == "name=systemd":
+			return fields[2], nil
+		case fields[0] == "0" && fields[1] == "":
+			unified, found = fields[2], true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("no systemd or unified cgroup")
+	}
+	return unified, nil
 }
 
 func readCpuProcStatFromStr(numCpu int, kind CpuTicksKind, data string) ([]CpuTicks, error) {
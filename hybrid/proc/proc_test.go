@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/google/go-cmp/cmp"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
 )
 
 func Test_readPidProcStatFromStr(t *testing.T) {
@@ -47,6 +48,77 @@ func Test_readPidProcStatFromStr(t *testing.T) {
 	}
 }
 
+func Test_ParsePidStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     uint32
+		stats   string
+		want    PidStat
+		wantErr bool
+	}{
+		{
+			name:  "full stat line",
+			pid:   5209,
+			stats: "5209 (cat) R 5205 5209 5205 0 -1 4194304 80 0 0 0 7 3 0 0 20 0 1 0 51176 2703360 305 18446744073709551615 94554842959872 94554842979753 140723309592864 0 0 0 0 0 0 0 0 0 17 5 0 0 0 0 0 94554842995760 94554842997376 94555481698304 140723309593925 140723309593945 140723309593945 140723309596651 0",
+			want: PidStat{
+				Pid:       5209,
+				Comm:      "cat",
+				State:     'R',
+				Ppid:      5205,
+				Session:   5205,
+				Utime:     7,
+				Stime:     3,
+				StartTime: 51176,
+				Processor: 5,
+			},
+		},
+		{
+			name:  "comm with spaces and parentheses",
+			pid:   42,
+			stats: "42 (a (b) c) S 1 42 42 0 -1 4194304 80 0 0 0 120 30 0 0 20 0 1 0 900",
+			want: PidStat{
+				Pid:       42,
+				Comm:      "a (b) c",
+				State:     'S',
+				Ppid:      1,
+				Session:   42,
+				Utime:     120,
+				Stime:     30,
+				StartTime: 900,
+			},
+		},
+		{
+			name:    "truncated",
+			pid:     42,
+			stats:   "42 (sleep) S 1 42 42 0",
+			wantErr: true,
+		},
+		{
+			name:    "missing comm",
+			pid:     42,
+			stats:   "42 sleep S 1 42 42 0 -1 4194304 80 0 0 0 120 30 0 0 20 0 1 0 900",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := ParsePidStat(tt.pid, tt.stats)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("ParsePidStat() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("ParsePidStat() succeeded unexpectedly")
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("ParsePidStat() got: %v, want: %v, diff: %v", got, tt.want, cmp.Diff(got, tt.want))
+			}
+		})
+	}
+}
+
 func Test_readCpuProcStatFromStr(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -116,37 +188,118 @@ func Test_readCpuProcStatFromStr(t *testing.T) {
 	}
 }
 
+func Test_ParseBootTime(t *testing.T) {
+	data := `cpu  100 0 300 0 0 0 0 0 0 0
+cpu0 110 0 310 0 0 0 0 0 0 0
+intr 0
+ctxt 123
+btime 1792323134
+processes 5210
+`
+	got, err := ParseBootTime(data)
+	if err != nil {
+		t.Fatalf("ParseBootTime() failed: %v", err)
+	}
+	if got != 1792323134 {
+		t.Errorf("ParseBootTime() got: %v, want: %v", got, 1792323134)
+	}
+	if _, err := ParseBootTime("cpu 1 2 3"); err == nil {
+		t.Error("ParseBootTime() succeeded unexpectedly")
+	}
+}
+
+func Test_ParseCgroupPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "unified",
+			data: "0::/system.slice/sshd.service\n",
+			want: "/system.slice/sshd.service",
+		},
+		{
+			name: "hybrid",
+			data: `12:pids:/system.slice/cron.service
+1:name=systemd:/system.slice/cron.service
+0::/
+`,
+			want: "/system.slice/cron.service",
+		},
+		{
+			name: "root",
+			data: "0::/\n",
+			want: "/",
+		},
+		{
+			name:    "v1 without systemd",
+			data:    "4:memory:/a\n1:cpu:/\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCgroupPath(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCgroupPath() error: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseCgroupPath() got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_NsToTicks(t *testing.T) {
+	tests := []struct {
+		ns   uint64
+		want CpuTicks
+	}{
+		{ns: 0, want: 0},
+		{ns: 9_999_999, want: 0},
+		{ns: 10_000_000, want: 1},
+		{ns: 2_345_000_000, want: 234},
+	}
+	for _, tt := range tests {
+		if got := NsToTicks(tt.ns); got != tt.want {
+			t.Errorf("NsToTicks(%d) got: %v, want: %v", tt.ns, got, tt.want)
+		}
+	}
+}
+
 func Test_getIsolatedCPUsFromStr(t *testing.T) {
 	tests := []struct {
 		name    string
 		data    string
-		want    []int
+		want    []CPUId
 		wantErr bool
 	}{
 		{
 			name: "no isolated cpus",
 			data: "",
-			want: []int{},
+			want: []CPUId{},
 		},
 		{
 			name: "simple comma separated",
 			data: "1,2",
-			want: []int{1, 2},
+			want: []CPUId{1, 2},
 		},
 		{
 			name: "isolated single range with two cpus",
 			data: "2-3",
-			want: []int{2, 3},
+			want: []CPUId{2, 3},
 		},
 		{
 			name: "isolated single range with multiple cpus",
 			data: "2-5",
-			want: []int{2, 3, 4, 5},
+			want: []CPUId{2, 3, 4, 5},
 		},
 		{
 			name: "isolated multiple ranges",
 			data: "2-3,12-15",
-			want: []int{2, 3, 12, 13, 14, 15},
+			want: []CPUId{2, 3, 12, 13, 14, 15},
 		},
 		{
 			name:    "non number range",
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/hist"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+)
+
+type runqDrainer interface {
+	DrainRunqLatency() (ebpf.RunqLatency, error)
+}
+
+// runqInterval is a JSON line of runqlat --json
+type runqInterval struct {
+	Time     time.Time `json:"time"`
+	Interval string    `json:"interval"`
+	All      hist.Log2 `json:"all"`
+	ebpf.RunqLatency
+	// PerProcess hides the one of RunqLatency, to add the units
+	PerProcess []procRunqLatency `json:"per_process,omitempty"`
+}
+
+// procRunqLatency is a process of runqlat --json, with its systemd unit
+// with --units
+type procRunqLatency struct {
+	ebpf.ProcRunqLatency
+	systemd.Unit
+}
+
+// runqlat prints the run queue latency of every loop interval
+func runqlat(ctx context.Context, s *session, perCPU bool, top int, jsonFile string) error {
+	if s.runq == nil {
+		return fmt.Errorf("run queue latency not measured")
+	}
+	var enc *json.Encoder
+	if jsonFile != "" {
+		f, err := os.OpenFile(jsonFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %w", jsonFile, err)
+		}
+		defer f.Close()
+		enc = json.NewEncoder(f)
+	}
+	return s.loop(ctx, func(ts, startedAt time.Time) bool {
+		lat, err := s.runq.DrainRunqLatency()
+		if err != nil {
+			log.Error("cannot drain run queue latency", "error", err)
+			return true
+		}
+		all := lat.All()
+		fmt.Fprintf(os.Stdout, "\n%s\n", ts.Format(time.TimeOnly))
+		printRunqHist(os.Stdout, "all cpus", all)
+		if perCPU {
+			cpus := slices.Sorted(maps.Keys(lat.PerCPU))
+			for _, cpu := range cpus {
+				printRunqHist(os.Stdout, fmt.Sprintf("cpu %d", cpu), lat.PerCPU[cpu])
+			}
+		}
+		// the highest tail latency first
+		slices.SortFunc(lat.PerProcess, func(a, b ebpf.ProcRunqLatency) int {
+			return cmp.Or(
+				cmp.Compare(b.Hist.Percentile(99), a.Hist.Percentile(99)),
+				cmp.Compare(b.Hist.Total(), a.Hist.Total()),
+				cmp.Compare(a.Pid, b.Pid),
+			)
+		})
+		procs := make([]procRunqLatency, len(lat.PerProcess))
+		for i, p := range lat.PerProcess {
+			procs[i].ProcRunqLatency = p
+			if s.units != nil && (i < top || enc != nil) {
+				procs[i].Unit = s.units.Of(p.Pid)
+			}
+		}
+		for _, p := range procs[:min(top, len(procs))] {
+			name := fmt.Sprintf("pid %d (%s)", p.Pid, p.Comm)
+			if s.units != nil {
+				name += " " + p.Unit.String()
+			}
+			printRunqHist(os.Stdout, name, p.Hist)
+		}
+		if enc != nil {
+			err := enc.Encode(runqInterval{
+				Time:        ts,
+				Interval:    s.interval.String(),
+				All:         all,
+				RunqLatency: lat,
+				PerProcess:  procs,
+			})
+			if err != nil {
+				log.Error("cannot write run queue latency", "error", err)
+			}
+		}
+		return true
+	})
+}
+
+func printRunqHist(w io.Writer, name string, h hist.Log2) {
+	fmt.Fprintf(w, "%s: %d waits, p50 %dus, p99 %dus\n", name, h.Total(), h.Percentile(50), h.Percentile(99))
+	if h.Total() > 0 {
+		h.Print(w, "usecs")
+	}
+}
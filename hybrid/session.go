@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"time"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/proctable"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/record"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/systemd"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+)
+
+// session provides the ticks and the raw inputs of a command, either live
+// from ebpf and /proc, optionally recorded, or replayed from a recording
+type session struct {
+	src          record.Source
+	isolatedCPUs []CPUId
+	interval     time.Duration
+	strategy     string
+
+	bpf interface{ Close() }
+	// runq is set for the runqlat command
+	runq runqDrainer
+	// events is set for the events command, procs with --proc-events
+	events <-chan ebpf.ProcEvent
+	procs  *proctable.Table
+	// units resolves the systemd unit of processes with --units, from
+	// /proc/<pid>/cgroup read through src
+	units *systemd.Resolver
+	// stats is set when --bpf-stats enabled the kernel bpf stats
+	stats       *bpfStats
+	statsCloser io.Closer
+	// inserts is set when the run queue latency or the off-cpu time is
+	// measured
+	inserts  *failedInserts
+	writer   *record.Writer
+	recorder *record.Recorder
+	reader   *record.Reader
+	replayer *record.Replayer
+}
+
+func openSession(cmd string) (*session, error) {
+	runqLatency := cmd == runqlatCmd.FullCommand()
+	printEvents := cmd == eventsCmd.FullCommand()
+	if (runqLatency || printEvents) && (*replayFile != "" || *recordFile != "") {
+		return nil, fmt.Errorf("%s cannot record or replay", cmd)
+	}
+	if *procEvents && *replayFile != "" {
+		return nil, fmt.Errorf("--proc-events cannot replay")
+	}
+	if *replayFile != "" {
+		r, hdr, err := record.Open(*replayFile)
+		if err != nil {
+			return nil, err
+		}
+		// the recorded inputs only suit the strategy they were recorded with
+		strategy := hdr.Strategy
+		if strategy == "" {
+			strategy = strategyProc
+		}
+		log.Info("Replaying", "file", *replayFile, "tool", hdr.Tool, "interval", hdr.Interval, "strategy", strategy)
+		replayer := record.NewReplayer(r)
+		s := &session{
+			src:          replayer,
+			isolatedCPUs: hdr.IsolatedCPUs,
+			interval:     hdr.Interval,
+			strategy:     strategy,
+			reader:       r,
+			replayer:     replayer,
+		}
+		if *systemdUnits {
+			s.units = systemd.NewResolver(s.src.PidCgroup)
+		}
+		return s, nil
+	}
+
+	strategies := []string{*strategy}
+	if *strategy == strategyAuto {
+		strategies = usableStrategies(ebpf.Probe())
+	}
+	isolatedCPUs, err := proc.GetIsolatedCPUs()
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		isolatedCPUs: isolatedCPUs,
+		interval:     *loopInterval,
+	}
+	needsBpf := *enableBpfStats || *offCPU || *procEvents || runqLatency || printEvents
+	if strategies[0] != strategyAllProc {
+		bpfInstance, err := ebpf.Instance(ebpf.Options{
+			Pin:                   *pinName,
+			ActiveProcsMap:        ebpf.ActiveProcsMap(*activeMap),
+			RunqLatency:           runqLatency,
+			RunqLatencyPerProcess: runqLatency && *runqlatPerProcess,
+			OffCPU:                *offCPU,
+			ProcEvents:            *procEvents || printEvents,
+		})
+		if err != nil {
+			if needsBpf || !slices.Contains(strategies, strategyAllProc) {
+				return nil, err
+			}
+			// auto falls back to the strategy without ebpf
+			log.Info("Strategy unavailable", "strategy", strategies[:len(strategies)-1], "reason", err)
+		} else {
+			s.bpf = bpfInstance
+			log.Info("Attached sched_switch", "attach", bpfInstance.AttachType(), "map", *activeMap, "pin", *pinName, "reused", bpfInstance.PinReused())
+			if runqLatency {
+				s.runq = bpfInstance
+			}
+			if runqLatency || *offCPU {
+				s.inserts = newFailedInserts(bpfInstance)
+			}
+			if printEvents {
+				s.events = bpfInstance.Events()
+			} else if *procEvents {
+				s.procs = proctable.New(*runRollup != "" || *systemdUnits)
+				go s.procs.Run(bpfInstance.Events())
+			}
+			// proc loads nothing, so auto never gets to allproc here
+			strategy, procTimes, err := loadStrategy(bpfInstance, strategies)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.strategy = strategy
+			s.src = record.Live(bpfInstance, procTimes)
+			if *enableBpfStats {
+				closer, err := ebpf.EnableStats()
+				if err != nil {
+					s.Close()
+					return nil, err
+				}
+				s.statsCloser = closer
+				s.stats = &bpfStats{bpf: bpfInstance}
+			}
+		}
+	}
+	if s.src == nil {
+		if needsBpf {
+			return nil, fmt.Errorf("--bpf-stats, --off-cpu, --proc-events, runqlat and events need a strategy using ebpf")
+		}
+		if len(strategies) > 1 {
+			log.Info("Strategy picked", "strategy", strategyAllProc)
+		}
+		s.strategy = strategyAllProc
+		s.src = record.Live(nil, nil)
+	}
+	if *recordFile != "" {
+		w, err := record.Create(*recordFile, record.Header{
+			Tool:         toolName,
+			NumCPU:       runtime.NumCPU(),
+			IsolatedCPUs: isolatedCPUs,
+			Interval:     *loopInterval,
+			Strategy:     s.strategy,
+		})
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("cannot record: %w", err)
+		}
+		s.writer = w
+		s.recorder = record.NewRecorder(s.src, w)
+		s.src = s.recorder
+	}
+	if *systemdUnits {
+		s.units = systemd.NewResolver(s.src.PidCgroup)
+	}
+	return s, nil
+}
+
+/*
+loop calls fn once per tick until fn returns false, ctx is done, or the
+recording being replayed ends. startedAt is when the tick was processed,
+which for a live tick is the tick time.
+*/
+func (s *session) loop(ctx context.Context, fn func(ts, startedAt time.Time) bool) error {
+	if s.replayer != nil {
+		ticks := 0
+		for ctx.Err() == nil {
+			ts, err := s.replayer.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			ticks++
+			if !fn(ts, time.Now()) {
+				break
+			}
+		}
+		log.Info("Replay finished", "ticks", ticks)
+		return nil
+	}
+
+	log.Info("Starting loop", "interval", s.interval)
+	ticker := time.Tick(s.interval)
+	oldTs := time.Now()
+	for {
+		select {
+		case newTs := <-ticker:
+			timeDiffSec := newTs.Sub(oldTs).Seconds()
+			if timeDiffSec < 0.1 {
+				continue
+			}
+			more := fn(newTs, newTs)
+			if s.inserts != nil {
+				s.inserts.check()
+			}
+			if s.recorder != nil {
+				if err := s.recorder.Commit(newTs); err != nil {
+					log.Error("cannot record tick", "error", err)
+				}
+			}
+			if !more {
+				return nil
+			}
+
+		case <-ctx.Done():
+			log.Info("loop finished...")
+			return nil
+		}
+	}
+}
+
+func (s *session) Close() {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			log.Error("cannot close recording", "error", err)
+		}
+	}
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	if s.statsCloser != nil {
+		s.statsCloser.Close()
+	}
+	if s.bpf != nil {
+		s.bpf.Close()
+	}
+}
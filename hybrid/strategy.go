@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	log "log/slog"
+
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/ebpf"
+	"github.com/vimalk78/ebpf-proc-hybrid/internal/record"
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+)
+
+// strategyNeeds lists the strategies from the cheapest, with the kernel
+// features each needs, see comparison/hybrid-task-iter.md for the costs
+var strategyNeeds = []struct {
+	strategy string
+	needs    []ebpf.Feature
+}{
+	{strategySyscall, []ebpf.Feature{ebpf.FeatureBTF, ebpf.FeatureBatchOps, ebpf.FeatureTaskFromPid}},
+	{strategyTaskIter, []ebpf.Feature{ebpf.FeatureBTF, ebpf.FeatureBatchOps, ebpf.FeatureTaskIter}},
+	// sched_switch falls back to tracepoints without BTF or tp_btf
+	{strategyProc, []ebpf.Feature{ebpf.FeatureBatchOps}},
+	{strategyAllProc, nil},
+}
+
+// usableStrategies returns the strategies the features allow, from the
+// cheapest, and logs why the others were skipped
+func usableStrategies(features ebpf.Features) []string {
+	var strategies []string
+	for _, s := range strategyNeeds {
+		if err := features.Missing(s.needs...); err != nil {
+			log.Info("Strategy unavailable", "strategy", s.strategy, "reason", err)
+			continue
+		}
+		strategies = append(strategies, s.strategy)
+	}
+	return strategies
+}
+
+type procTimesLoader interface {
+	LoadTaskIter() error
+	IterProcTimes(pids []Pid) ([]ebpf.ProcTimes, error)
+	LoadLookupTasks() error
+	LookupProcTimes(pids []Pid) ([]ebpf.ProcTimes, error)
+}
+
+// loadProcTimes loads the programs strategy reads cpu times with, nil if it
+// reads /proc
+func loadProcTimes(bpf procTimesLoader, strategy string) (record.ProcTimesFunc, error) {
+	switch strategy {
+	case strategyTaskIter:
+		if err := bpf.LoadTaskIter(); err != nil {
+			return nil, err
+		}
+		return bpf.IterProcTimes, nil
+	case strategySyscall:
+		if err := bpf.LoadLookupTasks(); err != nil {
+			return nil, err
+		}
+		return bpf.LookupProcTimes, nil
+	}
+	return nil, nil
+}
+
+/*
+loadStrategy loads the first of strategies whose programs load, and returns
+it with the func it reads cpu times with, nil if it reads /proc. The errors
+of every strategy are returned if none loads.
+*/
+func loadStrategy(bpf procTimesLoader, strategies []string) (string, record.ProcTimesFunc, error) {
+	var errs []error
+	for _, s := range strategies {
+		procTimes, err := loadProcTimes(bpf, s)
+		if err != nil {
+			log.Info("Strategy unavailable", "strategy", s, "reason", err)
+			errs = append(errs, fmt.Errorf("%s: %w", s, err))
+			continue
+		}
+		if len(strategies) > 1 {
+			log.Info("Strategy picked", "strategy", s)
+		}
+		return s, procTimes, nil
+	}
+	return "", nil, errors.Join(errs...)
+}
+
+// printProbe writes the kernel features and the strategies they allow
+func printProbe(w io.Writer, features ebpf.Features) {
+	fmt.Fprintf(w, "%-18s %s\n", "feature", "available")
+	for _, f := range ebpf.AllFeatures {
+		fmt.Fprintf(w, "%-18s %s\n", f, availability(features[f]))
+	}
+	fmt.Fprintf(w, "\n%-18s %s\n", "strategy", "usable")
+	for _, s := range strategyNeeds {
+		fmt.Fprintf(w, "%-18s %s\n", s.strategy, availability(features.Missing(s.needs...)))
+	}
+}
+
+func availability(err error) string {
+	if err != nil {
+		return fmt.Sprintf("no (%v)", err)
+	}
+	return "yes"
+}
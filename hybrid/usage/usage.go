@@ -0,0 +1,93 @@
+package usage
+
+import (
+	. "github.com/vimalk78/ebpf-proc-hybrid/internal/types"
+	"github.com/vimalk78/ebpf-proc-hybrid/proc"
+)
+
+// Delta is the cpu time a process used since the previous Update
+type Delta struct {
+	proc.PidStat
+	Ticks proc.CpuTicks
+	// New is set when the process started after the previous Update
+	New bool
+}
+
+// Tracker computes per process cpu time deltas between collection ticks.
+// A process is identified by its pid and start time, so a reused pid is
+// treated as a new process.
+type Tracker struct {
+	last map[Pid]proc.PidStat
+
+	// lastUptime is the time since boot of the previous Update, in ticks
+	lastUptime proc.CpuTicks
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		last: map[Pid]proc.PidStat{},
+	}
+}
+
+/*
+Update returns the cpu time used by each of stats since the previous Update.
+uptime is the time since boot at which stats were read.
+
+A process seen for the first time is accounted with all its cpu time if it
+started after the previous Update, otherwise it only becomes the baseline
+for the next Update. Processes not present in stats are remembered, as the
+hybrid approach reads only processes which were active in the interval.
+*/
+func (t *Tracker) Update(uptime proc.CpuTicks, stats []proc.PidStat) []Delta {
+	deltas := make([]Delta, 0, len(stats))
+	for _, stat := range stats {
+		deltas = append(deltas, t.delta(stat))
+		t.last[stat.Pid] = stat
+	}
+	t.lastUptime = uptime
+	return deltas
+}
+
+/*
+Exited returns the cpu time used since the previous Update by the exited
+process of stat, which holds its final cpu time, and forgets it. It is
+accounted as in Update, so the cpu time read while it was alive is not
+counted twice.
+*/
+func (t *Tracker) Exited(stat proc.PidStat) Delta {
+	delta := t.delta(stat)
+	if prev, ok := t.last[stat.Pid]; ok && prev.StartTime == stat.StartTime {
+		delete(t.last, stat.Pid)
+	}
+	return delta
+}
+
+func (t *Tracker) delta(stat proc.PidStat) Delta {
+	delta := Delta{PidStat: stat}
+	prev, exists := t.last[stat.Pid]
+	switch {
+	case exists && prev.StartTime == stat.StartTime:
+		// counters never go backwards for the same process
+		if stat.Total() > prev.Total() {
+			delta.Ticks = stat.Total() - prev.Total()
+		}
+	case t.lastUptime != 0 && stat.StartTime >= t.lastUptime:
+		delta.Ticks = stat.Total()
+		delta.New = true
+	}
+	return delta
+}
+
+// Forget drops the baseline of an exited process
+func (t *Tracker) Forget(pid Pid) {
+	delete(t.last, pid)
+}
+
+// Sum returns the total cpu ticks of deltas
+func Sum(deltas []Delta) proc.CpuTicks {
+	var total proc.CpuTicks
+	for _, d := range deltas {
+		total += d.Ticks
+	}
+	return total
+}
@@ -0,0 +1,13 @@
+module github.com/vimalk78/workload
+
+go 1.24.1
+
+require (
+	github.com/alecthomas/kingpin v2.2.6+incompatible
+	golang.org/x/sys v0.30.0
+)
+
+require (
+	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
+	github.com/alecthomas/units v0.0.0-20240927000941-0f3dac36c52b // indirect
+)
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "log/slog"
+
+	"github.com/alecthomas/kingpin"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	app = kingpin.New("workload", "spawns a known process population to compare cpu usage collectors against")
+
+	runCmd      = app.Command("run", "spawn the workload").Default()
+	numIdle     = runCmd.Flag("idle", "number of idle processes").Default("0").Int()
+	numBusy     = runCmd.Flag("busy", "number of busy loop processes").Default("0").Int()
+	busyDuty    = runCmd.Flag("busy-duty", "percent of time each busy process spends on cpu, below 100 it sleeps every 10ms").Default("100").Int()
+	forkRate    = runCmd.Flag("fork-rate", "short-lived children forked per second").Default("0").Float64()
+	childCPU    = runCmd.Flag("child-cpu", "cpu time burnt by each short-lived child").Default("5ms").Duration()
+	pinnedCPUs  = runCmd.Flag("pinned", "cpus to run one pinned busy thread on, e.g. 2,3 or 2-5. isolated cpus are allowed").String()
+	runDuration = runCmd.Flag("duration", "how long to run, 0 to run until Ctrl-C").Default("0").Duration()
+
+	// children, run by re-executing this binary
+	idleCmd    = app.Command("idle", "").Hidden()
+	busyCmd    = app.Command("busy", "").Hidden()
+	busyDutyIn = busyCmd.Flag("duty", "").Default("100").Int()
+	pinnedCmd  = app.Command("pinned", "").Hidden()
+	pinnedIn   = pinnedCmd.Flag("cpus", "").Required().String()
+	shortCmd   = app.Command("short", "").Hidden()
+	shortBurn  = shortCmd.Flag("burn", "").Required().Duration()
+)
+
+func init() {
+	// keep main on the main thread, so that prctl names the process
+	runtime.LockOSThread()
+}
+
+func main() {
+	var err error
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case runCmd.FullCommand():
+		err = run()
+	case idleCmd.FullCommand():
+		setName("wl-idle")
+		for {
+			time.Sleep(time.Hour)
+		}
+	case busyCmd.FullCommand():
+		setName("wl-busy")
+		busyLoop(*busyDutyIn)
+	case pinnedCmd.FullCommand():
+		setName("wl-pinned")
+		err = pinnedLoop(*pinnedIn)
+	case shortCmd.FullCommand():
+		setName("wl-short")
+		burn(*shortBurn)
+	}
+	if err != nil {
+		log.Error("workload failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run spawns the children, forks the short-lived ones until done, then
+// compares the cpu time the children used with the expected cpu time
+func run() error {
+	cpus, err := parseCPUList(*pinnedCPUs)
+	if err != nil {
+		return err
+	}
+	if *busyDuty < 1 || *busyDuty > 100 {
+		return fmt.Errorf("busy-duty must be within 1-100")
+	}
+	// the fork interval is at least 1ns
+	if *forkRate < 0 || *forkRate > float64(time.Second) {
+		return fmt.Errorf("fork-rate must be within 0-%d", time.Second)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *runDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *runDuration)
+		defer cancel()
+	}
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stopper
+		cancel()
+	}()
+
+	// expected cpu seconds per second of the whole workload
+	expected := float64(*numBusy)*float64(*busyDuty)/100 + float64(len(cpus)) + *forkRate*childCPU.Seconds()
+	log.Info("Starting workload",
+		"idle", *numIdle,
+		"busy", *numBusy,
+		"busy-duty", *busyDuty,
+		"pinned", cpus,
+		"fork-rate", *forkRate,
+		"child-cpu", *childCPU,
+		"expected-cpu-per-sec", expected,
+	)
+
+	var children []*exec.Cmd
+	spawn := func(args ...string) error {
+		cmd := exec.Command(self, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("cannot start %v: %w", args, err)
+		}
+		children = append(children, cmd)
+		log.Info("Spawned", "kind", args[0], "pid", cmd.Process.Pid)
+		return nil
+	}
+	startedAt := time.Now()
+	for i := 0; i < *numIdle && err == nil; i++ {
+		err = spawn("idle")
+	}
+	for i := 0; i < *numBusy && err == nil; i++ {
+		err = spawn("busy", "--duty", strconv.Itoa(*busyDuty))
+	}
+	if err == nil && len(cpus) > 0 {
+		err = spawn("pinned", "--cpus", *pinnedCPUs)
+	}
+	if err != nil {
+		killChildren(children)
+		return err
+	}
+
+	forked := 0
+	var wg sync.WaitGroup
+	if *forkRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *forkRate))
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+				cmd := exec.Command(self, "short", "--burn", childCPU.String())
+				if err := cmd.Start(); err != nil {
+					log.Error("cannot fork short-lived child", "error", err)
+					continue
+				}
+				forked++
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					cmd.Wait()
+				}()
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		ticker.Stop()
+	} else {
+		<-ctx.Done()
+	}
+	elapsed := time.Since(startedAt)
+
+	killChildren(children)
+	wg.Wait()
+
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &ru); err != nil {
+		return err
+	}
+	actual := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	log.Info("Workload finished",
+		"elapsed", elapsed.Round(time.Millisecond),
+		"forked", forked,
+		"expected-cpu", time.Duration(expected*float64(elapsed)).Round(time.Millisecond),
+		"children-cpu", actual.Round(time.Millisecond),
+	)
+	return nil
+}
+
+// killChildren kills the children and waits for them
+func killChildren(children []*exec.Cmd) {
+	for _, cmd := range children {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// busyLoop burns cpu for duty percent of every 10ms
+func busyLoop(duty int) {
+	const period = 10 * time.Millisecond
+	on := period * time.Duration(duty) / 100
+	for {
+		burn(on)
+		if on < period {
+			time.Sleep(period - on)
+		}
+	}
+}
+
+// pinnedLoop runs one busy thread pinned to each cpu of list
+func pinnedLoop(list string) error {
+	cpus, err := parseCPUList(list)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(cpus))
+	for _, cpu := range cpus {
+		go func() {
+			runtime.LockOSThread()
+			var set unix.CPUSet
+			set.Set(cpu)
+			if err := unix.SchedSetaffinity(0, &set); err != nil {
+				errs <- fmt.Errorf("cannot pin to cpu %d: %w", cpu, err)
+				return
+			}
+			setName(fmt.Sprintf("wl-pin-%d", cpu))
+			for {
+				burn(time.Hour)
+			}
+		}()
+	}
+	return <-errs
+}
+
+// burn spins until the calling thread used d of cpu time
+func burn(d time.Duration) {
+	start := threadCPUTime()
+	for threadCPUTime()-start < d {
+		for range 10000 {
+		}
+	}
+}
+
+func threadCPUTime() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_THREAD_CPUTIME_ID, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
+
+// setName sets the comm of the calling thread, as seen in /proc/<pid>/stat
+func setName(name string) {
+	p, err := unix.BytePtrFromString(name)
+	if err != nil {
+		return
+	}
+	unix.Prctl(unix.PR_SET_NAME, uintptr(unsafe.Pointer(p)), 0, 0, 0)
+}
+
+// parseCPUList parses a cpu list like 1,2,5-7
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		begin, end, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(begin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu %s", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(end); err != nil || last < first {
+				return nil, fmt.Errorf("invalid range %s", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}